@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API serves the latest states and history as JSON. It only reads what the Pollers captured,
+// so asking it never triggers extra logins on routers. Routes about a router take it as `router`,
+// which defaults to the first one.
+type API struct {
+	history   *History // nil when disabled
+	outages   *OutageTracker
+	metrics   *Metrics
+	routers   []string               // Names, in the order of the config
+	intervals []func() time.Duration // Of the Pollers of routers, which may change
+
+	mu     sync.Mutex
+	latest map[string]*State
+}
+
+// NewAPI constructs an API of the routers of given names, history may be nil
+func NewAPI(history *History, outages *OutageTracker, metrics *Metrics, names []string, intervals []func() time.Duration) *API {
+	return &API{
+		history:   history,
+		outages:   outages,
+		metrics:   metrics,
+		routers:   names,
+		intervals: intervals,
+		latest:    map[string]*State{},
+	}
+}
+
+// Consume caches a captured state, it's meant to be a Poller consumer
+func (a *API) Consume(state *State) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.latest[state.Router] = state
+}
+
+// adopt takes the latest states of previous over, of routers which are still known
+func (a *API) adopt(previous *API) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, name := range a.routers {
+		if state, ok := previous.latest[name]; ok {
+			a.latest[name] = state
+		}
+	}
+}
+
+// Latest returns the last state captured from the router of given name, or nil
+func (a *API) Latest(name string) *State {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.latest[name]
+}
+
+// router is the router asked for by req, the first one when it's not given. It responds with 404
+// and returns false when there is no such router.
+func (a *API) router(w http.ResponseWriter, req *http.Request) (int, bool) {
+	name := req.FormValue("router")
+	if name == "" {
+		return 0, true
+	}
+	for i, known := range a.routers {
+		if known == name {
+			return i, true
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "no such router")
+	return 0, false
+}
+
+// ofRouter tells whether state was captured from the router at index i. States from before routers were
+// named belong to the first router.
+func (a *API) ofRouter(state *State, i int) bool {
+	return state.Router == a.routers[i] || (state.Router == "" && i == 0)
+}
+
+// Register adds the API routes to mux
+func (a *API) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/status", a.serveStatus)
+	mux.HandleFunc("/api/v1/history", a.serveHistory)
+	mux.HandleFunc("/api/v1/health", a.serveHealth)
+	mux.HandleFunc("/api/v1/outages", a.serveOutages)
+	mux.HandleFunc("/api/v1/counters", a.serveCounters)
+	mux.HandleFunc("/api/v1/routers", a.serveRouters)
+}
+
+// serveStatus responds with the latest state of a router
+func (a *API) serveStatus(w http.ResponseWriter, req *http.Request) {
+	i, ok := a.router(w, req)
+	if !ok {
+		return
+	}
+	state := a.Latest(a.routers[i])
+	if state == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "nothing captured yet")
+		return
+	}
+	data, err := marshalState(state)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// serveHistory responds with states of a router captured between `from` and `to`, RFC 3339 times or Unix seconds.
+// They default to an hour ago and now. With `step` (a Go duration), only the first state in every step is kept,
+// along with every state of different health than the previous one.
+func (a *API) serveHistory(w http.ResponseWriter, req *http.Request) {
+	if a.history == nil {
+		writeJSONError(w, http.StatusNotFound, "history is disabled")
+		return
+	}
+	i, ok := a.router(w, req)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	from, err := parseTimeParam(req.FormValue("from"), now.Add(-time.Hour))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad from: "+err.Error())
+		return
+	}
+	to, err := parseTimeParam(req.FormValue("to"), now)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad to: "+err.Error())
+		return
+	}
+	var step time.Duration
+	if value := req.FormValue("step"); value != "" {
+		if step, err = time.ParseDuration(value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "bad step: "+err.Error())
+			return
+		}
+	}
+
+	all, err := a.history.Range(from, to)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var states []*State
+	for _, state := range all {
+		if a.ofRouter(state, i) {
+			states = append(states, state)
+		}
+	}
+	if step > 0 {
+		states = thinStates(states, step)
+	}
+	if states == nil {
+		states = []*State{}
+	}
+	writeJSON(w, http.StatusOK, states)
+}
+
+// healthResponse is the health of a router, or of all of them
+type healthResponse struct {
+	Health      string     `json:"health"`
+	Description string     `json:"description"`
+	CapturedAt  *time.Time `json:"captured_at,omitempty"`
+	// Stale is set when the poller did not capture for a while
+	Stale bool `json:"stale"`
+}
+
+// health is the health of the router at index i
+func (a *API) health(i int) healthResponse {
+	state := a.Latest(a.routers[i])
+	if state == nil {
+		return healthResponse{Health: "unknown", Description: "nothing captured yet", Stale: true}
+	}
+	return healthResponse{
+		Health:      string(Evaluate(state)),
+		Description: describeState(state),
+		CapturedAt:  &state.CapturedAt,
+		Stale:       time.Since(state.CapturedAt) > a.intervals[i]()*3,
+	}
+}
+
+// serveHealth responds with the health of the network of a router, or the worst of all routers when none is
+// given, with status 503 when it's down or unknown
+func (a *API) serveHealth(w http.ResponseWriter, req *http.Request) {
+	var response healthResponse
+	if req.FormValue("router") != "" || len(a.routers) == 1 {
+		i, ok := a.router(w, req)
+		if !ok {
+			return
+		}
+		response = a.health(i)
+	} else {
+		var descriptions []string
+		for i, name := range a.routers {
+			health := a.health(i)
+			descriptions = append(descriptions, name+": "+health.Description)
+			if i == 0 || healthRank(Health(health.Health)) > healthRank(Health(response.Health)) {
+				response.Health = health.Health
+			}
+			response.Stale = response.Stale || health.Stale
+			if health.CapturedAt != nil && (response.CapturedAt == nil || health.CapturedAt.Before(*response.CapturedAt)) {
+				response.CapturedAt = health.CapturedAt
+			}
+		}
+		response.Description = strings.Join(descriptions, "; ")
+	}
+
+	status := http.StatusServiceUnavailable
+	if response.Health != "unknown" && Health(response.Health) != HealthError && !response.Stale {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, response)
+}
+
+// serveRouters responds with the routers in the order of the config, along with their health
+func (a *API) serveRouters(w http.ResponseWriter, req *http.Request) {
+	type routerResponse struct {
+		Name string `json:"name"`
+		healthResponse
+	}
+	routers := []routerResponse{}
+	for i, name := range a.routers {
+		routers = append(routers, routerResponse{Name: name, healthResponse: a.health(i)})
+	}
+	writeJSON(w, http.StatusOK, routers)
+}
+
+// serveOutages responds with outages started since `from`, which defaults to a week ago. They are of every
+// router, unless one is given.
+func (a *API) serveOutages(w http.ResponseWriter, req *http.Request) {
+	i, ok := a.router(w, req)
+	if !ok {
+		return
+	}
+	from, err := parseTimeParam(req.FormValue("from"), time.Now().Add(-time.Hour*24*7))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "bad from: "+err.Error())
+		return
+	}
+	all, err := a.outages.Since(from)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var outages []*Outage
+	for _, o := range all {
+		if req.FormValue("router") == "" || o.Router == a.routers[i] || (o.Router == "" && i == 0) {
+			outages = append(outages, o)
+		}
+	}
+	if outages == nil {
+		outages = []*Outage{}
+	}
+	writeJSON(w, http.StatusOK, outages)
+}
+
+// serveCounters responds with login and scrape counters of a router since start
+func (a *API) serveCounters(w http.ResponseWriter, req *http.Request) {
+	i, ok := a.router(w, req)
+	if !ok {
+		return
+	}
+	counters, _ := a.metrics.Counters(a.routers[i])
+	writeJSON(w, http.StatusOK, counters)
+}
+
+// thinStates keeps the first state of every step, and states of different health than the previous one
+func thinStates(states []*State, step time.Duration) []*State {
+	var (
+		thinned    []*State
+		lastKept   time.Time
+		lastHealth Health
+	)
+	for _, state := range states {
+		health := Evaluate(state)
+		if state.CapturedAt.Sub(lastKept) < step && health == lastHealth {
+			continue
+		}
+		thinned = append(thinned, state)
+		lastKept, lastHealth = state.CapturedAt, health
+	}
+	return thinned
+}
+
+// parseTimeParam parses an RFC 3339 time or Unix seconds, an empty value gives fallback
+func parseTimeParam(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*1e9)), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Debug().Err(err).Msg("Failed to write JSON response")
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -1,34 +1,41 @@
+//go:build !notray
+// +build !notray
+
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"github.com/PuerkitoBio/goquery"
 	"github.com/getlantern/systray"
-	"golang.org/x/net/html"
-	"net/http"
-	"net/http/cookiejar"
-	"net/url"
 	"otecstar/icons"
+	"otecstar/router"
 	"strings"
+	"sync"
 	"time"
 )
 
-const VERSION = "v0.2.1"
-
-// State represents a captured state (snapshot) from the router
-type State struct {
-	wlanState string
-	linkState string
-	linkLoss  string
-	upWidth   string
-	upSNR     string
-	downWidth string
-	downSNR   string
-}
-
 // OTECStarApp embeds all necessary data to start up our application
 type OTECStarApp struct {
+	// routers are the menus of routers, in the order of pollers
+	routers []*routerMenu
+	outages *systray.MenuItem
+	// outageItems are sub items of outages, one per recent outage
+	outageItems []*systray.MenuItem
+	dashboard   *systray.MenuItem
+	pollers     []*Poller
+	reloader    *Reloader
+
+	mu sync.Mutex // Pollers render at once
+	// names, healths and descriptions are of the last state of each router, the icon shows the worst health
+	names        []string
+	healths      []Health
+	descriptions []string
+	icon         string
+}
+
+// routerMenu shows the state of a router
+type routerMenu struct {
+	// parent holds the items as a submenu when there are several routers, it's nil otherwise
+	parent    *systray.MenuItem
 	wlanState *systray.MenuItem
 	linkState *systray.MenuItem
 	linkLoss  *systray.MenuItem
@@ -36,19 +43,24 @@ type OTECStarApp struct {
 	upSNR     *systray.MenuItem
 	downWidth *systray.MenuItem
 	downSNR   *systray.MenuItem
-	stopCh    chan int
-	auth      AuthContainer
-	icon      string
 }
 
-// AuthContainer embeds all data specific to router authentication
-type AuthContainer struct {
-	routerIP      string
-	loginUrl      string
-	stateUrl      string
-	sysauthCookie *http.Cookie
-	username      string
-	password      string
+// newRouterMenu adds the items of a router, in a submenu titled with name unless it's the single router
+func newRouterMenu(name string, single bool) *routerMenu {
+	m := routerMenu{}
+	add := systray.AddMenuItem
+	if !single {
+		m.parent = systray.AddMenuItem(name+": -", "")
+		add = m.parent.AddSubMenuItem
+	}
+	m.wlanState = add("宽带: -", "")
+	m.linkState = add("链路: -", "")
+	m.linkLoss = add("链路衰减: -", "")
+	m.upWidth = add("↑ 上行速率: -", "")
+	m.upSNR = add("↑ 上行信噪比: -", "")
+	m.downWidth = add("↓ 下行速率: -", "")
+	m.downSNR = add("↓ 下行信噪比: -", "")
+	return &m
 }
 
 // Clicked connects a given MenuItem's clicked event to given function
@@ -59,187 +71,117 @@ func (*OTECStarApp) Clicked(which *systray.MenuItem, callback func()) {
 	}()
 }
 
-// login authenticates against the router, and set necessary data to `app.auth` for future consumption
-func (o *OTECStarApp) login() error {
-	/**
-	Login: POST http://{ROUTER_IP}/cgi-bin/luci/customer/ with {username, password, login_in=登录}
-	Login returns cookies: sysauth={SYS_AUTH}; path=/cgi-bin/luci/;stok={STOCK}
-	Get state from this page: http://{ROUTER_IP}/cgi-bin/luci/;stok={STOCK}/customer/status/wan/
-	If form#sysauth[name="sysauth"] is presented in responding HTML, it means we need to login again.
-	*/
-	data := url.Values{}
-	data.Set("username", o.auth.username)
-	data.Set("password", o.auth.password)
-	data.Set("login_in", "登录")
-
-	postData := bytes.Buffer{}
-	postData.WriteString(data.Encode())
-
-	logger.Debug().Msg("login")
-	resp, err := http.Post(
-		fmt.Sprintf(o.auth.loginUrl, o.auth.routerIP),
-		"application/x-www-form-urlencoded",
-		&postData,
-	)
-	if err != nil {
-		return err
+// renderState renders a state of the router at index i
+func (o *OTECStarApp) renderState(i int, state *State) {
+	health := Evaluate(state)
+	o.routers[i].render(state)
+
+	o.mu.Lock()
+	o.names[i], o.healths[i], o.descriptions[i] = state.Router, health, describeState(state)
+	worst := o.healths[0]
+	for _, h := range o.healths {
+		if healthRank(h) > healthRank(worst) {
+			worst = h
+		}
 	}
-
-	// Golang http does not honor `;` in cookie values, so we must do this manually
-	for _, header := range resp.Header.Values("set-cookie") {
-		for _, cookieStr := range strings.Split(header, "; ") {
-			logger.Debug().Str("cookieStr", cookieStr).Msg("Processing...")
-			_c := strings.SplitN(cookieStr, "=", 2)
-			if len(_c) != 2 {
-				logger.Debug().Str("cookie", cookieStr).Msg("Skipped bad cookie string")
-				continue
-			}
-			name, value := _c[0], _c[1]
-			if name == `path` {
-				o.auth.stateUrl = fmt.Sprintf(`http://%%s/%s/customer/status/wan/`, value)
-				logger.Debug().Str("stateUrl", o.auth.stateUrl).Msg("stateUrl updated")
-				continue
-			}
-			if name == `sysauth` {
-				o.auth.sysauthCookie = &http.Cookie{Name: name, Value: value}
-				logger.Debug().Msg("Got sysauth cookie")
+	tooltip := "OTECStar: " + o.descriptions[0]
+	if len(o.routers) > 1 {
+		var lines []string
+		for j, name := range o.names {
+			if o.healths[j] != "" {
+				lines = append(lines, name+": "+o.descriptions[j])
 			}
 		}
+		tooltip = "OTECStar\n" + strings.Join(lines, "\n")
 	}
+	o.setIcon(string(worst))
+	o.mu.Unlock()
+	systray.SetTooltip(tooltip)
 
-	if o.auth.sysauthCookie == nil {
-		return fmt.Errorf(`failed to login`)
-	}
-	logger.Debug().Interface("sysauthCookie", o.auth.sysauthCookie).Msg("login OK")
-	return nil
+	o.renderOutages(state.CapturedAt)
 }
 
-// getState captures a state from the router
-func (o *OTECStarApp) getState() *State {
-	/**
-	Login: POST http://{ROUTER_IP}/cgi-bin/luci/customer/ with {username, password, login_in=登录}
-	Login returns cookies: sysauth={SYS_AUTH}; path=/cgi-bin/luci/;stok={STOCK}
-	Get state from this page: http://{ROUTER_IP}/cgi-bin/luci/;stok={STOCK}/customer/status/wan/
-	If form#sysauth[name="sysauth"] is presented in responding HTML, it means we need to login again.
-	*/
-	state := State{
-		wlanState: "-",
-		linkState: "-",
-		linkLoss:  "-",
-		upWidth:   "-",
-		upSNR:     "-",
-		downWidth: "-",
-		downSNR:   "-",
-	}
-
-	logger.Debug().Msg("getState")
-	// Login for the first time
-	if o.auth.sysauthCookie == nil {
-		if err := o.login(); err != nil {
-			logger.Error().Err(err).Msg("Failed to login")
-			state.wlanState = "ERROR: " + err.Error()
-			return &state
+// render shows a state in the items
+func (m *routerMenu) render(state *State) {
+	if m.parent != nil {
+		title := state.Router + ": " + connStateText(state.WAN)
+		if state.Err != nil {
+			title = state.Router + ": ERROR"
 		}
+		m.parent.SetTitle(title)
 	}
 
-	// Get state
-	jar, _ := cookiejar.New(nil)
-	client := http.Client{
-		Jar:     jar,
-		Timeout: time.Second * 5,
-	}
-	stateUrl := fmt.Sprintf(o.auth.stateUrl, o.auth.routerIP)
-	u, _ := url.Parse(stateUrl)
-	jar.SetCookies(u, []*http.Cookie{o.auth.sysauthCookie})
-
-	resp, err := client.Get(stateUrl)
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to access WAN state page")
-		state.wlanState = "ERROR: " + err.Error()
-		return &state
-	}
-
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
-	if err != nil {
-		logger.Error().Err(err).Msg("Failed to parse WAN page response")
-		state.wlanState = "ERROR: " + err.Error()
-		return &state
-	}
-
-	// Check state response, if our authentication expired, do another login
-	if doc.Find(`form#sysauth`).Length() > 0 {
-		logger.Info().Msg("Login expired, retrying")
-		o.auth.sysauthCookie = nil
-		return o.getState()
-	}
-
-	dataTables := doc.Find(`table.cbi-table-list`)
-	if dataTables.Length() != 4 {
-		logger.Error().Msg("Unexpected data tables")
-		state.wlanState = "ERROR: 未预期的数据表格式"
-		return &state
+	if state.Err != nil {
+		m.wlanState.SetTitle("宽带: ERROR: " + state.Err.Error())
+	} else {
+		m.wlanState.SetTitle("宽带: " + connStateText(state.WAN))
 	}
-	dataTables.Each(func(index int, table *goquery.Selection) {
-		if index == 2 {
-			state.wlanState = table.Find(`td.cbi-table-field`).Last().Text()
-		} else if index == 3 {
-			linkTable := table.Find(`td.cbi-table-field`)
-			state.linkState = getText(linkTable.Get(0))
-			state.linkLoss = getText(linkTable.Get(1))
-			state.upWidth = getText(linkTable.Get(2))
-			state.downWidth = getText(linkTable.Get(3))
-			state.upSNR = getText(linkTable.Get(4))
-			state.downSNR = getText(linkTable.Get(5))
-		}
-	})
-	return &state
-}
-
-func (o *OTECStarApp) renderState(state *State) {
-	icon := "ok"
-
-	o.wlanState.SetTitle("宽带: " + state.wlanState)
-	if state.wlanState == `连接上` {
-		if !o.wlanState.Checked() {
-			o.wlanState.Check()
+	if state.Err == nil && state.WAN == router.Connected {
+		if !m.wlanState.Checked() {
+			m.wlanState.Check()
 		}
 	} else {
-		if o.wlanState.Checked() {
-			o.wlanState.Uncheck()
+		if m.wlanState.Checked() {
+			m.wlanState.Uncheck()
 		}
-		icon = "error"
 	}
 
-	o.linkState.SetTitle("链路: " + state.linkState)
-	if state.linkState == `连接上` {
-		if !o.linkState.Checked() {
-			o.linkState.Check()
+	m.linkState.SetTitle("链路: " + connStateText(state.Link))
+	if state.Err == nil && state.Link == router.Connected {
+		if !m.linkState.Checked() {
+			m.linkState.Check()
 		}
 	} else {
-		if o.linkState.Checked() {
-			o.linkState.Uncheck()
+		if m.linkState.Checked() {
+			m.linkState.Uncheck()
 		}
-		icon = "error"
 	}
 
-	o.linkLoss.SetTitle("链路衰减: " + state.linkLoss + " dB")
-	o.upWidth.SetTitle("↑ 上行速率: " + state.upWidth + " Mbps")
-	o.upSNR.SetTitle("↑ 上行信噪比: " + state.upSNR + " dB")
-	o.downWidth.SetTitle("↓ 下行速率: " + state.downWidth + " Mbps")
-	o.downSNR.SetTitle("↓ 下行信噪比: " + state.downSNR + " dB")
-
-	if icon != "error" && (state.linkLoss == "0" || state.upSNR == "0" || state.downSNR == "0") {
-		icon = "warn"
+	// Readings of a failed capture are meaningless
+	reading := func(v float64) string {
+		if state.Err != nil {
+			return "-"
+		}
+		return formatNumber(v)
 	}
+	m.linkLoss.SetTitle("链路衰减: " + reading(state.LinkLoss) + " dB")
+	m.upWidth.SetTitle("↑ 上行速率: " + reading(state.UpRate) + " Mbps")
+	m.upSNR.SetTitle("↑ 上行信噪比: " + reading(state.UpSNR) + " dB")
+	m.downWidth.SetTitle("↓ 下行速率: " + reading(state.DownRate) + " Mbps")
+	m.downSNR.SetTitle("↓ 下行信噪比: " + reading(state.DownSNR) + " dB")
+}
 
-	o.setIcon(icon)
-
-	if icon == "ok" {
-		systray.SetTooltip("OTECStar: network OK")
-	} else if icon == "warn" {
-		systray.SetTooltip("OTECStar: network unstable")
-	} else if icon == "error" {
-		systray.SetTooltip("OTECStar: network disconnected")
+func (o *OTECStarApp) renderOutages(now time.Time) {
+	tracker := o.reloader.Outputs().outages
+	if tracker == nil {
+		// Outputs failed to restart on reload
+		return
+	}
+	outages := tracker.Recent(len(o.outageItems))
+	if len(outages) == 0 {
+		o.outages.SetTitle("最近断线: 无")
+	} else {
+		o.outages.SetTitle(fmt.Sprintf("最近断线: %d", len(outages)))
+	}
+	for i, item := range o.outageItems {
+		if i >= len(outages) {
+			item.Hide()
+			continue
+		}
+		outage := outages[i]
+		end, duration := "至今", outage.Duration(now).Round(time.Second).String()
+		if outage.End != nil {
+			end = outage.End.Local().Format("15:04:05")
+		} else if outage.Interrupted {
+			end, duration = "?", "?"
+		}
+		title := fmt.Sprintf("%s - %s (%s) %s",
+			outage.Start.Local().Format("01-02 15:04:05"), end, duration, outage.Cause)
+		if len(o.routers) > 1 && outage.Router != "" {
+			title = outage.Router + ": " + title
+		}
+		item.SetTitle(title)
+		item.Show()
 	}
 }
 
@@ -260,72 +202,82 @@ func (o *OTECStarApp) setIcon(icon string) {
 	o.icon = icon
 }
 
-func getText(node *html.Node) (t string) {
-	if node.Type == html.TextNode {
-		t = node.Data
-		return
-	}
-
-	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		t += getText(c)
+// renderDashboard shows the dashboard item only when there is an HTTP listener serving the dashboard
+func (o *OTECStarApp) renderDashboard() {
+	if o.reloader.Outputs().DashboardURL() == "" {
+		o.dashboard.Hide()
+	} else {
+		o.dashboard.Show()
 	}
-	return
 }
 
-// NewOTECStarApp constructs a new OTECStarApp instance that is ready to run
-func NewOTECStarApp(config *Config) *OTECStarApp {
+// NewOTECStarApp constructs a new OTECStarApp instance rendering states from pollers, one per router, it's
+// ready once pollers run. A single router is shown at the top level, several ones in submenus.
+func NewOTECStarApp(pollers []*Poller, reloader *Reloader) *OTECStarApp {
 	app := OTECStarApp{
-		wlanState: systray.AddMenuItem("宽带: -", ""),
-		linkState: systray.AddMenuItem("链路: -", ""),
-		linkLoss:  systray.AddMenuItem("链路衰减: -", ""),
-		upWidth:   systray.AddMenuItem("↑ 上行速率: -", ""),
-		upSNR:     systray.AddMenuItem("↑ 上行信噪比: -", ""),
-		downWidth: systray.AddMenuItem("↓ 下行速率: -", ""),
-		downSNR:   systray.AddMenuItem("↓ 下行信噪比: -", ""),
-		stopCh:    make(chan int),
-		auth: AuthContainer{
-			routerIP:      config.RouterIP,
-			loginUrl:      "http://%s/cgi-bin/luci/customer/",
-			stateUrl:      "",
-			sysauthCookie: nil,
-			username:      config.Username,
-			password:      config.Password,
-		},
+		pollers:      pollers,
+		reloader:     reloader,
+		names:        make([]string, len(pollers)),
+		healths:      make([]Health, len(pollers)),
+		descriptions: make([]string, len(pollers)),
+	}
+	for _, poller := range pollers {
+		app.routers = append(app.routers, newRouterMenu(poller.Name(), len(pollers) == 1))
 	}
 	app.setIcon("ok")
 	systray.SetTooltip("OTECStar network status")
 
 	systray.AddSeparator()
-	systray.AddMenuItem(VERSION, "").Disable()
-	systray.AddSeparator()
-
-	if config.Interval < time.Second {
-		logger.Warn().Dur("interval", config.Interval).
-			Dur("actualInterval", time.Second).
-			Msg("Interval should be at least 1 second")
-		config.Interval = time.Second
+	app.outages = systray.AddMenuItem("最近断线: -", "Recent outages")
+	for i := 0; i < 5; i++ {
+		item := app.outages.AddSubMenuItem("", "")
+		item.Disable()
+		item.Hide()
+		app.outageItems = append(app.outageItems, item)
 	}
-	ticker := time.NewTicker(config.Interval)
-	app.Clicked(systray.AddMenuItem("Quit", ""), func() {
-		ticker.Stop()
-		close(app.stopCh)
-		systray.Quit()
+	app.renderOutages(time.Now())
+
+	app.dashboard = systray.AddMenuItem("打开仪表盘", "Open dashboard")
+	app.renderDashboard()
+	go func() {
+		for range app.dashboard.ClickedCh {
+			url := app.reloader.Outputs().DashboardURL()
+			if err := openBrowser(url); err != nil {
+				logger.Error().Err(err).Str("url", url).Msg("Failed to open dashboard")
+			}
+		}
+	}()
+	app.reloader.OnReload(func(*Config) {
+		app.renderDashboard()
+		app.renderOutages(time.Now())
 	})
 
-	// This goroutine triggers state capturing at an interval, the captured state is then rendered in place
+	systray.AddSeparator()
+	reload := systray.AddMenuItem("重新加载配置", "Reload config")
 	go func() {
-		for {
-			select {
-			case <-app.stopCh:
-				return
-			case _, ok := <-ticker.C:
-				if !ok { // Closed?
-					return
-				}
-				app.renderState(app.getState())
+		for range reload.ClickedCh {
+			if err := app.reloader.Reload(); err != nil {
+				systray.SetTooltip("OTECStar: config not reloaded, " + err.Error())
 			}
 		}
 	}()
+	systray.AddMenuItem(VERSION, "").Disable()
+	systray.AddSeparator()
+
+	app.Clicked(systray.AddMenuItem("Quit", ""), func() {
+		for _, poller := range app.pollers {
+			poller.Stop()
+		}
+		systray.Quit()
+	})
+
+	// Pollers trigger state capturing at their interval, captured states are then rendered in place
+	for i, poller := range app.pollers {
+		i := i
+		poller.OnState(func(state *State) {
+			app.renderState(i, state)
+		})
+	}
 
 	return &app
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"otecstar/router"
+	"time"
+)
+
+// breakerFirstPause is how long polling pauses when the breaker first opens, it doubles while the router keeps failing
+const breakerFirstPause = time.Second * 30
+
+// nextBackoff doubles backoff up to max, with up to 20% jitter
+func nextBackoff(backoff, max time.Duration) time.Duration {
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	return withJitter(doubled(backoff, max))
+}
+
+// doubled is d doubled, capped to max unless max is 0
+func doubled(d, max time.Duration) time.Duration {
+	d *= 2
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// withJitter adds up to 20% to d, so that retries don't fall in step
+func withJitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+// PausedError wraps the failure which made the Breaker pause polling
+type PausedError struct {
+	Err   error
+	Until time.Time
+}
+
+func (e *PausedError) Error() string {
+	return fmt.Sprintf("%s, retrying in %s", e.Err, e.retryIn())
+}
+
+func (e *PausedError) Unwrap() error {
+	return e.Err
+}
+
+// Summary is a short sentence like `Auth failing, retrying in 2m0s`
+func (e *PausedError) Summary() string {
+	var what string
+	switch router.Classify(e.Err) {
+	case router.FailureAuth:
+		what = "Auth failing"
+	case router.FailureNetwork:
+		what = "Router unreachable"
+	case router.FailureSession:
+		what = "Session keeps expiring"
+	case router.FailureFormat:
+		what = "Router page not understood"
+	default:
+		what = "Router failing"
+	}
+	return fmt.Sprintf("%s, retrying in %s", what, e.retryIn())
+}
+
+func (e *PausedError) retryIn() time.Duration {
+	d := time.Until(e.Until).Round(time.Second)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Breaker pauses polling once captures failed too many times in a row, so a router which refuses
+// us is not hammered every tick. It is not safe for concurrent use.
+type Breaker struct {
+	config *RetryConfig
+
+	failures  int // In a row
+	pause     time.Duration
+	openUntil time.Time
+}
+
+// NewBreaker constructs a closed Breaker
+func NewBreaker(config *RetryConfig) *Breaker {
+	return &Breaker{config: config}
+}
+
+// Allow tells whether the router should be polled now
+func (b *Breaker) Allow(now time.Time) bool {
+	return !now.Before(b.openUntil)
+}
+
+// Record counts a captured state. When it makes the breaker open, state.Err is wrapped into a PausedError.
+func (b *Breaker) Record(state *State) {
+	if state.Err == nil {
+		if b.failures >= b.config.BreakAfter && b.config.BreakAfter > 0 {
+			logger.Info().Str("router", state.Router).Msg("Router is back, polling resumes")
+		}
+		b.failures, b.pause, b.openUntil = 0, 0, time.Time{}
+		return
+	}
+	b.failures++
+	if b.config.BreakAfter <= 0 || b.failures < b.config.BreakAfter {
+		return
+	}
+
+	if b.pause <= 0 {
+		b.pause = breakerFirstPause
+	} else {
+		b.pause *= 2
+	}
+	if b.config.MaxBackoff > 0 && b.pause > b.config.MaxBackoff {
+		b.pause = b.config.MaxBackoff
+	}
+	pause := withJitter(b.pause)
+	b.openUntil = state.CapturedAt.Add(state.RoundTrip + pause)
+	state.Err = &PausedError{Err: state.Err, Until: b.openUntil}
+	logger.Warn().Err(state.Err).Str("router", state.Router).Int("failures", b.failures).Dur("pause", pause).Msg("Polling paused")
+}
@@ -4,34 +4,573 @@ package main
 This module contains configuration related types and logic.
 */
 import (
+	"errors"
 	"fmt"
 	"gopkg.in/ini.v1"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	LogLevel    string        `ini:"log_level"`
-	Interval    time.Duration `ini:"interval"`
-	*AuthConfig `ini:"auth"`
+	LogLevel string        `ini:"log_level"`
+	Interval time.Duration `ini:"interval"`
+	// ConnectTimeout and ReadTimeout bound every request to the router
+	ConnectTimeout time.Duration `ini:"connect_timeout"`
+	ReadTimeout    time.Duration `ini:"read_timeout"`
+	*AuthConfig    `ini:"auth"`
+	HTTP           HTTPConfig    `ini:"http"`
+	History        HistoryConfig `ini:"history"`
+	Notify         NotifyConfig  `ini:"notify"`
+	MQTT           MQTTConfig    `ini:"mqtt"`
+	Retry          RetryConfig   `ini:"retry"`
+	// Webhooks are from `[webhook "name"]` sections
+	Webhooks []*WebhookConfig `ini:"-"`
+	// Rules are from `[rule "name"]` sections
+	Rules []*RuleConfig `ini:"-"`
+	// Routers are from `[router "name"]` sections. Without any, there is one router made of [auth] and
+	// interval, named by its router_ip.
+	Routers []*RouterConfig `ini:"-"`
+
+	// file is the config file loaded, empty when there is none
+	file string
+	// sources tell where the value of each key came from, see configKey.String for keys
+	sources map[string]string
 }
 type AuthConfig struct {
 	Username string `ini:"username"`
 	Password string `ini:"password"`
 	RouterIP string `ini:"router_ip"`
+	// PasswordStore is where the password is kept instead of Password: keyring or file, see set-password
+	PasswordStore string `ini:"password_store"`
+}
+
+// RouterConfig is a router to monitor, every router is polled on its own
+type RouterConfig struct {
+	// Name labels the router in metrics, events and the tray
+	Name string
+	*AuthConfig
+	Interval time.Duration
+	// Rules are those naming the router, and those naming none
+	Rules []*RuleConfig
+
+	// section is where the router came from, like `router "office"`, or auth
+	section string
+}
+
+// HTTPConfig configures the optional HTTP listener serving metrics and other outputs
+type HTTPConfig struct {
+	// Listen is the address to listen on, the listener is disabled when empty
+	Listen string `ini:"listen"`
+}
+
+// RetryConfig configures how failed captures are retried
+type RetryConfig struct {
+	// Attempts is how many times a capture is tried within a poll, auth failures are never retried
+	Attempts int `ini:"attempts"`
+	// Backoff is the delay before the first retry within a poll, it doubles for every next one up to MaxBackoff
+	Backoff time.Duration `ini:"backoff"`
+	// BreakAfter is how many failed polls in a row pause polling, 0 never pauses
+	BreakAfter int `ini:"break_after"`
+	// MaxBackoff caps the delay between retries, and the pause, which starts at 30s and doubles while the
+	// router keeps failing
+	MaxBackoff time.Duration `ini:"max_backoff"`
+}
+
+// HistoryConfig configures the on-disk store of captured states
+type HistoryConfig struct {
+	Enabled bool `ini:"enabled"`
+	// Path of the store, defaults to history.jsonl beside config.ini
+	Path string `ini:"path"`
+	// Retention is how long states are kept
+	Retention time.Duration `ini:"retention"`
+	// States older than DownsampleAfter are thinned to one per DownsampleInterval
+	DownsampleAfter    time.Duration `ini:"downsample_after"`
+	DownsampleInterval time.Duration `ini:"downsample_interval"`
+	// OutagesPath is where outages are logged, defaults to outages.jsonl beside config.ini
+	OutagesPath string `ini:"outages_path"`
+}
+
+// NotifyConfig configures desktop notifications on network status changes
+type NotifyConfig struct {
+	Enabled bool `ini:"enabled"`
+	// Backend is one of auto, log, or a platform one: dbus (Linux), osascript (macOS), toast (Windows)
+	Backend string `ini:"backend"`
+	// Debounce is how long a new status has to last before it's notified
+	Debounce time.Duration `ini:"debounce"`
+}
+
+// WebhookConfig configures a webhook fired on network status changes
+type WebhookConfig struct {
+	Name        string `ini:"-"`
+	URL         string `ini:"url"`
+	Method      string `ini:"method"`
+	ContentType string `ini:"content_type"`
+	// Template is a Go text/template rendering the request body, see WebhookEvent for the data
+	Template string `ini:"template"`
+	// TemplateFile is read as Template if set
+	TemplateFile string `ini:"template_file"`
+	// Debounce is how long a new status has to last before it's sent
+	Debounce time.Duration `ini:"debounce"`
+	// MaxBackoff caps the delay between delivery retries
+	MaxBackoff time.Duration `ini:"max_backoff"`
+}
+
+// RuleConfig configures a threshold on a reading, which makes the health warn or error when crossed
+type RuleConfig struct {
+	Name string `ini:"-"`
+	// Metric is one of link_loss, up_rate, down_rate, up_snr, down_snr, round_trip
+	Metric string `ini:"metric"`
+	// Min and Max are the bounds of good readings, nil when not set
+	Min *float64 `ini:"-"`
+	Max *float64 `ini:"-"`
+	// For is how long a reading has to stay out of bounds before the rule fires
+	For time.Duration `ini:"for"`
+	// Level is the health when the rule fires, warn or error
+	Level string `ini:"level"`
+	// Hysteresis is how far back within bounds a reading has to get before a fired rule recovers
+	Hysteresis float64 `ini:"hysteresis"`
+	// Router limits the rule to the router of that name, it applies to every router when empty
+	Router string `ini:"router"`
+}
+
+// MQTTConfig configures publishing states to an MQTT broker
+type MQTTConfig struct {
+	// Broker is like tcp://127.0.0.1:1883, publishing is disabled when empty
+	Broker   string `ini:"broker"`
+	Username string `ini:"username"`
+	Password string `ini:"password"`
+	ClientID string `ini:"client_id"`
+	// QoS is 0, 1 or 2
+	QoS uint `ini:"qos"`
+	// TopicPrefix is prepended to every topic, which is like {topic_prefix}/{router}/state
+	TopicPrefix string `ini:"topic_prefix"`
+	// Discovery enables Home Assistant MQTT discovery under DiscoveryPrefix
+	Discovery       bool   `ini:"discovery"`
+	DiscoveryPrefix string `ini:"discovery_prefix"`
+}
+
+// durationType is the type of duration keys, which MapTo only sets when positive, see mapDurations
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// configEnvPrefix starts the names of environment variables overriding keys, see configKey.Env
+const configEnvPrefix = "OTECSTAR_"
+
+// errNoConfig is returned by LoadConfig when there is neither a config file nor a router set otherwise
+var errNoConfig = errors.New("no config file found")
+
+// configKey is a key of the config with its value, in the default section when Section is empty
+type configKey struct {
+	Section string
+	Name    string
+	Value   string
+	// Type is of the field the key maps to, values are not checked against it when nil
+	Type reflect.Type
+}
+
+// String names the key like section.name, or just name in the default section
+func (k configKey) String() string {
+	if k.Section == "" {
+		return k.Name
+	}
+	return k.Section + "." + k.Name
+}
+
+// Env is the environment variable overriding the key, like OTECSTAR_AUTH_PASSWORD
+func (k configKey) Env() string {
+	return configEnvPrefix + strings.ToUpper(strings.Replace(k.String(), ".", "_", -1))
+}
+
+// configKeys lists the keys of c along with their values, named sections like webhooks are left out
+func configKeys(c *Config) []configKey {
+	return appendConfigKeys(nil, "", reflect.ValueOf(c).Elem())
+}
+
+func appendConfigKeys(keys []configKey, section string, v reflect.Value) []configKey {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("ini")
+		if name == "" || name == "-" {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+		if field.Kind() == reflect.Struct {
+			keys = appendConfigKeys(keys, name, field)
+			continue
+		}
+		keys = append(keys, configKey{Section: section, Name: name, Value: fmt.Sprint(field.Interface()), Type: field.Type()})
+	}
+	return keys
+}
+
+// configSearchPaths are where config.ini is looked for, in order
+func configSearchPaths() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	if runtime.GOOS == "windows" {
+		dirs = append(dirs, filepath.Join(home, `otecstar`))
+	}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		dirs = append(dirs, filepath.Join(xdg, `otecstar`))
+	}
+	dirs = append(dirs, filepath.Join(home, `.config`, `otecstar`))
+	// %AppData% on Windows, ~/Library/Application Support on macOS
+	if dir, err := os.UserConfigDir(); err == nil {
+		dirs = append(dirs, filepath.Join(dir, `otecstar`))
+	}
+
+	var paths []string
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if !seen[dir] {
+			seen[dir] = true
+			paths = append(paths, filepath.Join(dir, `config.ini`))
+		}
+	}
+	return paths, nil
+}
+
+// configPath is the config file to use: the one given by --config or OTECSTAR_CONFIG, or else the first
+// of configSearchPaths which exists. When none does, it's the first of them and found is false.
+func configPath() (path string, found bool, err error) {
+	explicit := configFlags.path
+	if explicit == "" {
+		explicit = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+	if explicit != "" {
+		if _, err = os.Stat(explicit); os.IsNotExist(err) {
+			// It's where `otecstar setup` writes to
+			return explicit, false, nil
+		} else if err != nil {
+			return
+		}
+		return explicit, true, nil
+	}
+
+	var paths []string
+	if paths, err = configSearchPaths(); err != nil {
+		return
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path, true, nil
+		}
+	}
+	return paths[0], false, nil
+}
+
+// configDir is where config.ini and other files of ours live
+func configDir() (string, error) {
+	path, _, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(path), nil
+}
+
+// defaultConfig is the config before any file, environment variable or flag is applied
+func defaultConfig() Config {
+	return Config{
+		LogLevel:       "info",
+		Interval:       time.Second,
+		ConnectTimeout: time.Second * 3,
+		ReadTimeout:    time.Second * 5,
+		AuthConfig:     &AuthConfig{},
+		History: HistoryConfig{
+			Enabled:            true,
+			Retention:          time.Hour * 24 * 30,
+			DownsampleAfter:    time.Hour * 24,
+			DownsampleInterval: time.Minute,
+		},
+		Notify: NotifyConfig{
+			Enabled:  true,
+			Backend:  "auto",
+			Debounce: time.Second * 30,
+		},
+		MQTT: MQTTConfig{
+			ClientID:        "otecstar",
+			TopicPrefix:     "otecstar",
+			Discovery:       true,
+			DiscoveryPrefix: "homeassistant",
+		},
+		Retry: RetryConfig{
+			Attempts:   3,
+			Backoff:    time.Second,
+			BreakAfter: 3,
+			MaxBackoff: time.Minute * 5,
+		},
+	}
 }
 
+// LoadConfig loads the config, along with the passwords of routers from their stores
 func LoadConfig() (c Config, err error) {
-	var userHomeDir string
-	if userHomeDir, err = os.UserHomeDir(); err != nil {
+	if c, err = loadConfigFile(); err != nil {
 		return
 	}
-	if err = ini.MapTo(&c, filepath.Join(userHomeDir, `.config`, `otecstar`, `config.ini`)); err != nil {
+	for _, router := range c.Routers {
+		if router.PasswordStore == "" {
+			continue
+		}
+		if router.Password, err = loadPassword(router.PasswordStore, secretAccount(router.AuthConfig)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// loadConfigFile loads the config without looking into password stores. Values are layered, each one
+// overriding the previous: defaults, config.ini, OTECSTAR_* environment variables and command line flags.
+// Every problem found in them is returned at once, in a *ConfigError.
+func loadConfigFile() (c Config, err error) {
+	c = defaultConfig()
+	c.sources = map[string]string{}
+	for _, key := range configKeys(&c) {
+		c.sources[key.String()] = "default"
+	}
+
+	var (
+		path  string
+		found bool
+		file  *ini.File
+	)
+	if path, found, err = configPath(); err != nil {
 		return
 	}
-	if c.AuthConfig == nil {
-		err = fmt.Errorf("auth config empty")
+	if found {
+		if file, err = ini.Load(path); err != nil {
+			return
+		}
+		c.file = path
+		for _, section := range file.Sections() {
+			for _, key := range section.Keys() {
+				name := configKey{Name: key.Name()}
+				if section.Name() != ini.DefaultSection {
+					name.Section = section.Name()
+				}
+				c.sources[name.String()] = path
+			}
+		}
+	} else {
+		file = ini.Empty()
+	}
+	keys := configKeys(&c)
+	problems := checkEnv(keys)
+	for _, key := range keys {
+		if value, ok := os.LookupEnv(key.Env()); ok {
+			file.Section(key.Section).Key(key.Name).SetValue(value)
+			c.sources[key.String()] = "env " + key.Env()
+		}
+	}
+	for _, override := range configFlags.overrides {
+		file.Section(override.key.Section).Key(override.key.Name).SetValue(override.key.Value)
+		c.sources[override.key.String()] = "flag " + override.flag
+	}
+	problems = append(problems, checkConfigFile(file, &c)...)
+
+	if err = file.MapTo(&c); err != nil {
+		return
+	}
+	mapDurations(file, ini.DefaultSection, reflect.ValueOf(&c).Elem())
+	for _, section := range file.Sections() {
+		if name, ok := namedSection(section.Name(), "webhook"); ok {
+			webhook := WebhookConfig{
+				Name:        name,
+				Method:      "POST",
+				ContentType: "application/json",
+				Debounce:    time.Second * 30,
+				MaxBackoff:  time.Minute * 5,
+			}
+			if err = section.MapTo(&webhook); err != nil {
+				return
+			}
+			mapDurations(file, section.Name(), reflect.ValueOf(&webhook).Elem())
+			if webhook.URL == "" {
+				problems = append(problems, fmt.Sprintf("webhook %s: url empty", name))
+				continue
+			}
+			c.Webhooks = append(c.Webhooks, &webhook)
+		}
+		if name, ok := namedSection(section.Name(), "rule"); ok {
+			rule, err := loadRule(name, file, section)
+			if err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			c.Rules = append(c.Rules, rule)
+		}
+		if name, ok := namedSection(section.Name(), "router"); ok {
+			c.Routers = append(c.Routers, loadRouter(name, section, &c))
+		}
+	}
+	if len(c.Routers) == 0 {
+		c.Routers = []*RouterConfig{{
+			Name:       c.RouterIP,
+			AuthConfig: c.AuthConfig,
+			Interval:   c.Interval,
+			section:    "auth",
+		}}
+	}
+	for _, router := range c.Routers {
+		for _, rule := range c.Rules {
+			if rule.Router == "" || rule.Router == router.Name {
+				router.Rules = append(router.Rules, rule)
+			}
+		}
+	}
+	if c.RouterIP == "" && !found {
+		err = fmt.Errorf("%w, run `otecstar setup`, create %s or set router_ip with %s", errNoConfig, path, configKey{Section: "auth", Name: "router_ip"}.Env())
+		return
+	}
+	problems = append(problems, checkConfig(&c)...)
+	if len(problems) > 0 {
+		err = &ConfigError{Problems: problems}
+		return
+	}
+
+	dir := filepath.Dir(path)
+	if c.History.Path == "" {
+		c.History.Path = filepath.Join(dir, `history.jsonl`)
+	}
+	if c.History.OutagesPath == "" {
+		c.History.OutagesPath = filepath.Join(dir, `outages.jsonl`)
 	}
 	return
 }
+
+// router is the router of given name, or the first one when name is empty
+func (c *Config) router(name string) (*RouterConfig, error) {
+	var names []string
+	for _, router := range c.Routers {
+		if router.Name == name || name == "" {
+			return router, nil
+		}
+		names = append(names, router.Name)
+	}
+	return nil, fmt.Errorf("no router named %q, try one of %s", name, strings.Join(names, ", "))
+}
+
+// loadRouter reads a `[router "name"]` section. Credentials left out default to those in [auth],
+// and the interval to the global one.
+func loadRouter(name string, section *ini.Section, c *Config) *RouterConfig {
+	auth := AuthConfig{Username: c.Username}
+	// Either a password or its store is inherited, they don't go together
+	if !section.HasKey("password") && !section.HasKey("password_store") {
+		auth.Password, auth.PasswordStore = c.Password, c.PasswordStore
+	}
+	router := RouterConfig{
+		Name:       name,
+		AuthConfig: &auth,
+		Interval:   c.Interval,
+		section:    section.Name(),
+	}
+	// Values were checked by checkConfigFile, bad ones are deleted
+	_ = section.MapTo(&auth)
+	if interval, ok := keyDuration(section, "interval"); ok {
+		router.Interval = interval
+	}
+	return &router
+}
+
+// mapDurations sets the durations of v, mapped from the section of given name, to their values in file.
+// MapTo leaves durations which are not positive at their defaults, while 0 means something for some of them,
+// like debounce. Values were checked by checkConfigFile, bad ones are deleted.
+func mapDurations(file *ini.File, section string, v reflect.Value) {
+	s, err := file.GetSection(section)
+	if err != nil {
+		return
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("ini")
+		if name == "" || name == "-" {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+		if field.Kind() == reflect.Struct {
+			mapDurations(file, name, field)
+			continue
+		}
+		if field.Type() != durationType {
+			continue
+		}
+		if d, ok := keyDuration(s, name); ok {
+			field.SetInt(int64(d))
+		}
+	}
+}
+
+// keyDuration is the value of a duration key of section, false when it's missing, empty or invalid
+func keyDuration(section *ini.Section, name string) (time.Duration, bool) {
+	if !section.HasKey(name) {
+		return 0, false
+	}
+	d, err := time.ParseDuration(section.Key(name).String())
+	return d, err == nil
+}
+
+// loadRule reads a `[rule "name"]` section
+func loadRule(name string, file *ini.File, section *ini.Section) (*RuleConfig, error) {
+	rule := RuleConfig{
+		Name:  name,
+		Level: string(HealthWarn),
+	}
+	if err := section.MapTo(&rule); err != nil {
+		return nil, err
+	}
+	mapDurations(file, section.Name(), reflect.ValueOf(&rule).Elem())
+	if _, ok := ruleMetrics[rule.Metric]; !ok {
+		return nil, fmt.Errorf("rule %s: unknown metric %q", name, rule.Metric)
+	}
+	for _, key := range []string{"min", "max"} {
+		// Empty like `max =` is unset, as for any other key
+		if !section.HasKey(key) || strings.TrimSpace(section.Key(key).String()) == "" {
+			continue
+		}
+		v, err := section.Key(key).Float64()
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %s: %w", name, key, err)
+		}
+		if key == "min" {
+			rule.Min = &v
+		} else {
+			rule.Max = &v
+		}
+	}
+	if rule.Min == nil && rule.Max == nil {
+		return nil, fmt.Errorf("rule %s: min or max required", name)
+	}
+	if rule.Level != string(HealthWarn) && rule.Level != string(HealthError) {
+		return nil, fmt.Errorf("rule %s: level should be warn or error", name)
+	}
+	if rule.Hysteresis < 0 {
+		return nil, fmt.Errorf("rule %s: hysteresis should not be negative", name)
+	}
+	return &rule, nil
+}
+
+// namedSection tells whether a section is like `[kind "name"]`, and returns the name
+func namedSection(section, kind string) (string, bool) {
+	rest := strings.TrimPrefix(section, kind+" ")
+	if rest == section || len(rest) < 2 || rest[0] != '"' || rest[len(rest)-1] != '"' {
+		return "", false
+	}
+	return rest[1 : len(rest)-1], true
+}
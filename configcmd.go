@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+)
+
+// configCommands are the sub commands of `otecstar config`
+var configCommands = map[string]func(args []string) error{
+	"show":     runConfigShow,
+	"validate": runConfigValidate,
+}
+
+// runConfig runs a sub command about the config, like `otecstar config show`
+func runConfig(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: otecstar config show|validate")
+	}
+	command, ok := configCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown config command %q, try show or validate", args[0])
+	}
+	return command(args[1:])
+}
+
+// runConfigShow prints the effective config, along with where each value came from
+func runConfigShow(args []string) error {
+	flags := flag.NewFlagSet("config show", flag.ExitOnError)
+	addConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// Stdout is for the config, logs go elsewhere
+	setLogOutput(os.Stderr)
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	return printConfig(os.Stdout, &config)
+}
+
+// runConfigValidate checks the config, printing every problem found. It exits with 1 when there is any.
+func runConfigValidate(args []string) error {
+	flags := flag.NewFlagSet("config validate", flag.ExitOnError)
+	addConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	setLogOutput(os.Stderr)
+	// Loading the password tells whether its store works too
+	config, err := LoadConfig()
+	if err == nil {
+		if config.file != "" {
+			fmt.Printf("%s is valid\n", config.file)
+		} else {
+			fmt.Println("Config is valid")
+		}
+		return nil
+	}
+	problems := []string{err.Error()}
+	var invalid *ConfigError
+	if errors.As(err, &invalid) {
+		problems = invalid.Problems
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d problem(s) found\n", len(problems))
+	return exitStatus(1)
+}
+
+// printConfig writes config in the format of config.ini, commenting where each value came from.
+// Passwords are masked unless secrets are unsafely logged.
+func printConfig(w io.Writer, config *Config) error {
+	if config.file != "" {
+		fmt.Fprintf(w, "; Loaded from %s\n", config.file)
+	} else {
+		fmt.Fprintf(w, "; No config file found\n")
+	}
+
+	keys := configKeys(config)
+	for _, webhook := range config.Webhooks {
+		keys = appendConfigKeys(keys, fmt.Sprintf("webhook %q", webhook.Name), reflect.ValueOf(webhook).Elem())
+	}
+	for _, rule := range config.Rules {
+		section := fmt.Sprintf("rule %q", rule.Name)
+		keys = appendConfigKeys(keys, section, reflect.ValueOf(rule).Elem())
+		if rule.Min != nil {
+			keys = append(keys, configKey{Section: section, Name: "min", Value: formatNumber(*rule.Min)})
+		}
+		if rule.Max != nil {
+			keys = append(keys, configKey{Section: section, Name: "max", Value: formatNumber(*rule.Max)})
+		}
+	}
+
+	for _, router := range config.Routers {
+		if router.section == "auth" {
+			continue
+		}
+		keys = appendConfigKeys(keys, router.section, reflect.ValueOf(router.AuthConfig).Elem())
+		keys = append(keys, configKey{Section: router.section, Name: "interval", Value: router.Interval.String()})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	section := ""
+	for _, key := range keys {
+		if key.Section != section {
+			section = key.Section
+			fmt.Fprintf(tw, "\n[%s]\n", section)
+		}
+		source, ok := config.sources[key.String()]
+		if !ok {
+			// Named sections only come from the file, except what routers inherit from [auth] and interval
+			source = config.file
+			if _, isRouter := namedSection(key.Section, "router"); isRouter {
+				source = "inherited"
+			}
+		}
+		value := key.Value
+		if key.Name == "password" && value != "" && !unsafeLogSecrets {
+			value = redacted
+		}
+		fmt.Fprintf(tw, "%s\t= %s\t; %s\n", key.Name, quoteConfigValue(value), source)
+	}
+	return tw.Flush()
+}
+
+// quoteConfigValue quotes values which would be read differently in config.ini
+func quoteConfigValue(value string) string {
+	if value != strings.TrimSpace(value) || strings.ContainsAny(value, ";#\"\n") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
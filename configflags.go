@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// configOverride is a key set on the command line, by flag
+type configOverride struct {
+	key  configKey
+	flag string
+}
+
+// configFlags are the config file and overrides given on the command line, see addConfigFlags
+var configFlags struct {
+	path      string
+	overrides []configOverride
+}
+
+// configShorthands are flags for keys which are often overridden, any key can be set with --set
+var configShorthands = []struct {
+	flag string
+	key  configKey
+}{
+	{"log-level", configKey{Name: "log_level"}},
+	{"interval", configKey{Name: "interval"}},
+	{"router-ip", configKey{Section: "auth", Name: "router_ip"}},
+	{"username", configKey{Section: "auth", Name: "username"}},
+}
+
+// addConfigFlags adds the flags choosing the config file and overriding keys in it to flags of a command.
+// They are flag.Value, so adding them to more than one FlagSet does not reset what was parsed before.
+func addConfigFlags(flags *flag.FlagSet) {
+	flags.Var(configPathFlag{}, "config", "config file to use instead of searching for config.ini")
+	for _, shorthand := range configShorthands {
+		flags.Var(configKeyFlag{flag: "--" + shorthand.flag, key: shorthand.key}, shorthand.flag, "overrides "+shorthand.key.String())
+	}
+	flags.Var(configSetFlag{}, "set", "overrides any key like section.key=value, can be repeated")
+}
+
+type configPathFlag struct{}
+
+func (configPathFlag) String() string {
+	return configFlags.path
+}
+
+func (configPathFlag) Set(value string) error {
+	configFlags.path = value
+	return nil
+}
+
+type configKeyFlag struct {
+	flag string
+	key  configKey
+}
+
+func (f configKeyFlag) String() string {
+	return ""
+}
+
+func (f configKeyFlag) Set(value string) error {
+	key := f.key
+	key.Value = value
+	configFlags.overrides = append(configFlags.overrides, configOverride{key: key, flag: f.flag})
+	return nil
+}
+
+type configSetFlag struct{}
+
+func (configSetFlag) String() string {
+	return ""
+}
+
+func (configSetFlag) Set(value string) error {
+	eq := strings.Index(value, "=")
+	if eq < 0 {
+		return fmt.Errorf("should be like section.key=value")
+	}
+	key := configKey{Name: value[:eq], Value: value[eq+1:]}
+	if dot := strings.Index(key.Name, "."); dot >= 0 {
+		key.Section, key.Name = key.Name[:dot], key.Name[dot+1:]
+	}
+	defaults := defaultConfig()
+	for _, known := range configKeys(&defaults) {
+		if known.Section == key.Section && known.Name == key.Name {
+			configFlags.overrides = append(configFlags.overrides, configOverride{key: key, flag: "--set " + key.String()})
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown key %s", key)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// runDaemon polls the router without any UI until SIGINT or SIGTERM arrives, SIGHUP reloads the config
+func runDaemon(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	addConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := prepare()
+	if err != nil {
+		return err
+	}
+
+	pollers := NewPollers(config)
+	reloader, err := NewReloader(config, pollers)
+	if err != nil {
+		return err
+	}
+	defer reloader.Close()
+	logTransition := newTransitionLogger()
+	var running sync.WaitGroup
+	for _, poller := range pollers {
+		poller.OnState(logTransition)
+		poller.OnState(reloader.Consume)
+		running.Add(1)
+		go func(poller *Poller) {
+			defer running.Done()
+			poller.Run()
+		}(poller)
+	}
+	if err := reloader.Watch(); err != nil {
+		logger.Warn().Err(err).Msg("Config changes need SIGHUP to be applied")
+	}
+	for _, router := range config.Routers {
+		logger.Info().Str("router", router.Name).Str("routerIP", router.RouterIP).Dur("interval", router.Interval).Msg("Polling")
+	}
+	logger.Info().Str("version", VERSION).Msg("Daemon ready")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			_ = reloader.Reload()
+			continue
+		}
+		logger.Info().Str("signal", sig.String()).Msg("Stopping")
+		break
+	}
+	signal.Stop(signals)
+
+	for _, poller := range pollers {
+		poller.Stop()
+	}
+	running.Wait()
+	logger.Info().Msg("Quit")
+	return nil
+}
+
+// newTransitionLogger creates a state consumer that logs every state at debug level, and health changes of
+// every router at info level. It's safe to share between Pollers.
+func newTransitionLogger() func(state *State) {
+	var (
+		mu   sync.Mutex
+		last = map[string]Health{} // By router
+	)
+	return func(state *State) {
+		health := Evaluate(state)
+		event := logger.Debug()
+		mu.Lock()
+		if health != last[state.Router] {
+			event = logger.Info().Str("from", string(last[state.Router]))
+			last[state.Router] = health
+		}
+		mu.Unlock()
+		if state.Err != nil {
+			event = event.AnErr("stateErr", state.Err)
+		}
+		event.Str("router", state.Router).
+			Str("health", string(health)).
+			Str("wan", state.WAN.String()).
+			Str("link", state.Link.String()).
+			Float64("linkLoss", state.LinkLoss).
+			Float64("upRate", state.UpRate).
+			Float64("upSNR", state.UpSNR).
+			Float64("downRate", state.DownRate).
+			Float64("downSNR", state.DownSNR).
+			Dur("roundTrip", state.RoundTrip).
+			Msg(describeState(state))
+	}
+}
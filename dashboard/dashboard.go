@@ -0,0 +1,23 @@
+// Package dashboard serves a web dashboard built on the JSON API, assets are compiled into the binary.
+package dashboard
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// started is used as the modification time of assets
+var started = time.Now()
+
+// Handler serves the dashboard at /
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" && req.URL.Path != "/index.html" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		http.ServeContent(w, req, "index.html", started, strings.NewReader(indexHTML))
+	})
+}
@@ -0,0 +1,336 @@
+package dashboard
+
+// indexHTML is the whole dashboard, styles and scripts included, so it works without Internet access
+const indexHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>OTECStar</title>
+<style>
+  :root { --ok: #2e9d57; --warn: #d99a00; --error: #d64545; --muted: #7a7f87; --line: #e3e5e8; }
+  * { box-sizing: border-box; }
+  body { margin: 0; padding: 24px; font: 14px/1.5 -apple-system, "Segoe UI", "PingFang SC", sans-serif; color: #22262b; background: #f6f7f9; }
+  h1 { margin: 0 0 16px; font-size: 20px; }
+  h2 { margin: 0 0 8px; font-size: 15px; }
+  section { background: #fff; border: 1px solid var(--line); border-radius: 8px; padding: 16px; margin-bottom: 16px; }
+  .badge { display: inline-block; padding: 2px 10px; border-radius: 10px; color: #fff; background: var(--muted); font-weight: 600; }
+  .badge.ok { background: var(--ok); } .badge.warn { background: var(--warn); } .badge.error { background: var(--error); }
+  .grid { display: grid; grid-template-columns: repeat(auto-fill, minmax(150px, 1fr)); gap: 12px; }
+  .figure .label { color: var(--muted); font-size: 12px; }
+  .figure .value { font-size: 20px; font-weight: 600; }
+  .ranges button { border: 1px solid var(--line); background: #fff; padding: 4px 12px; border-radius: 4px; cursor: pointer; }
+  .ranges button.active { background: #22262b; color: #fff; }
+  canvas { width: 100%; height: 180px; display: block; }
+  .legend span { margin-right: 12px; font-size: 12px; }
+  .legend i { display: inline-block; width: 10px; height: 3px; margin-right: 4px; vertical-align: middle; }
+  #timeline { position: relative; height: 20px; background: #e9f5ee; border-radius: 4px; overflow: hidden; }
+  #timeline div { position: absolute; top: 0; bottom: 0; background: var(--error); min-width: 2px; }
+  table { width: 100%; border-collapse: collapse; font-size: 13px; }
+  th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid var(--line); }
+  th { color: var(--muted); font-weight: normal; }
+  .muted { color: var(--muted); }
+  #router { font: inherit; font-size: 15px; }
+</style>
+</head>
+<body>
+<h1>OTECStar <select id="router" hidden></select> <span id="health" class="badge">-</span> <span id="updated" class="muted"></span></h1>
+
+<section>
+  <div class="grid">
+    <div class="figure"><div class="label">宽带 WAN</div><div class="value" id="wan">-</div></div>
+    <div class="figure"><div class="label">链路 Link</div><div class="value" id="link">-</div></div>
+    <div class="figure"><div class="label">链路衰减 Attenuation</div><div class="value" id="link_loss_db">-</div></div>
+    <div class="figure"><div class="label">↑ 上行速率 Up rate</div><div class="value" id="up_rate_mbps">-</div></div>
+    <div class="figure"><div class="label">↓ 下行速率 Down rate</div><div class="value" id="down_rate_mbps">-</div></div>
+    <div class="figure"><div class="label">↑ 上行信噪比 Up SNR</div><div class="value" id="up_snr_db">-</div></div>
+    <div class="figure"><div class="label">↓ 下行信噪比 Down SNR</div><div class="value" id="down_snr_db">-</div></div>
+  </div>
+  <div id="error" class="muted"></div>
+</section>
+
+<section>
+  <div class="ranges">
+    <button data-range="3600" class="active">1 hour</button>
+    <button data-range="86400">1 day</button>
+    <button data-range="604800">1 week</button>
+    <span id="history-note" class="muted"></span>
+  </div>
+</section>
+
+<section>
+  <h2>SNR (dB)</h2>
+  <canvas id="snr"></canvas>
+  <div class="legend"><span><i style="background:#3b7ddd"></i>Up</span><span><i style="background:#8e44ad"></i>Down</span></div>
+</section>
+<section>
+  <h2>Attenuation (dB)</h2>
+  <canvas id="loss"></canvas>
+</section>
+<section>
+  <h2>Sync rate (Mbps)</h2>
+  <canvas id="rate"></canvas>
+  <div class="legend"><span><i style="background:#3b7ddd"></i>Up</span><span><i style="background:#8e44ad"></i>Down</span></div>
+</section>
+
+<section>
+  <h2>Outages</h2>
+  <div id="timeline"></div>
+  <table>
+    <thead><tr><th>Start</th><th>End</th><th>Duration</th><th>Cause</th></tr></thead>
+    <tbody id="outages"></tbody>
+  </table>
+</section>
+
+<section>
+  <h2>Errors since start</h2>
+  <div class="grid">
+    <div class="figure"><div class="label">Logins</div><div class="value" id="login_attempts">-</div></div>
+    <div class="figure"><div class="label">Failed logins</div><div class="value" id="login_failures">-</div></div>
+    <div class="figure"><div class="label">Expired sessions</div><div class="value" id="session_expiries">-</div></div>
+    <div class="figure"><div class="label">Scrapes</div><div class="value" id="scrapes">-</div></div>
+    <div class="figure"><div class="label">Failed scrapes</div><div class="value" id="scrape_failures">-</div></div>
+    <div class="figure"><div class="label">Unreachable</div><div class="value" id="network_failures">-</div></div>
+    <div class="figure"><div class="label">Auth refused</div><div class="value" id="auth_failures">-</div></div>
+    <div class="figure"><div class="label">Sessions lost</div><div class="value" id="session_failures">-</div></div>
+    <div class="figure"><div class="label">Unknown pages</div><div class="value" id="format_failures">-</div></div>
+  </div>
+</section>
+
+<script>
+(function () {
+  "use strict";
+  var range = 3600, states = [], outages = [], router = "";
+  var $ = function (id) { return document.getElementById(id); };
+  var UP = "#3b7ddd", DOWN = "#8e44ad", LOSS = "#2e9d57";
+
+  function getJSON(url) {
+    return fetch(url).then(function (resp) {
+      return resp.json().then(function (body) {
+        if (!resp.ok) { throw new Error(body.error || resp.statusText); }
+        return body;
+      });
+    });
+  }
+
+  // withRouter asks url about the selected router, the API defaults to the first one
+  function withRouter(url) {
+    if (!router) { return url; }
+    return url + (url.indexOf("?") < 0 ? "?" : "&") + "router=" + encodeURIComponent(router);
+  }
+
+  function formatTime(t, withDate) {
+    var d = new Date(t), pad = function (n) { return (n < 10 ? "0" : "") + n; };
+    var time = pad(d.getHours()) + ":" + pad(d.getMinutes()) + ":" + pad(d.getSeconds());
+    return withDate ? (d.getMonth() + 1) + "-" + pad(d.getDate()) + " " + time : time;
+  }
+
+  function formatDuration(ms) {
+    var s = Math.round(ms / 1000);
+    if (s < 60) { return s + "s"; }
+    if (s < 3600) { return Math.floor(s / 60) + "m" + (s % 60) + "s"; }
+    return Math.floor(s / 3600) + "h" + Math.floor(s % 3600 / 60) + "m";
+  }
+
+  function renderCurrent(state) {
+    var health = $("health");
+    health.textContent = state.health;
+    health.className = "badge " + state.health;
+    $("updated").textContent = "updated " + formatTime(state.captured_at);
+    $("wan").textContent = state.wan;
+    $("link").textContent = state.link;
+    var failed = !!state.error;
+    // Readings the router shows no number for are null
+    var reading = function (key, unit) {
+      return failed || state[key] === null || state[key] === undefined ? "-" : state[key] + " " + unit;
+    };
+    ["link_loss_db", "up_snr_db", "down_snr_db"].forEach(function (key) {
+      $(key).textContent = reading(key, "dB");
+    });
+    ["up_rate_mbps", "down_rate_mbps"].forEach(function (key) {
+      $(key).textContent = reading(key, "Mbps");
+    });
+    $("error").textContent = failed ? "Error: " + state.error : "";
+  }
+
+  // chart draws lines of series ({color, key}) over the selected range, skipping failed captures
+  function chart(canvas, series) {
+    var ratio = window.devicePixelRatio || 1;
+    var width = canvas.clientWidth, height = canvas.clientHeight;
+    canvas.width = width * ratio;
+    canvas.height = height * ratio;
+    var ctx = canvas.getContext("2d");
+    ctx.scale(ratio, ratio);
+    ctx.clearRect(0, 0, width, height);
+
+    var now = Date.now(), start = now - range * 1000;
+    var points = states.filter(function (s) { return !s.error; });
+    var min = Infinity, max = -Infinity;
+    points.forEach(function (s) {
+      series.forEach(function (line) {
+        if (s[line.key] === null) { return; }
+        min = Math.min(min, s[line.key]);
+        max = Math.max(max, s[line.key]);
+      });
+    });
+    if (!isFinite(min)) { min = 0; max = 1; }
+    if (min === max) { min -= 1; max += 1; }
+    var left = 44, right = 8, top = 8, bottom = 20;
+    var x = function (t) { return left + (t - start) / (now - start) * (width - left - right); };
+    var y = function (v) { return top + (max - v) / (max - min) * (height - top - bottom); };
+
+    ctx.strokeStyle = "#e3e5e8";
+    ctx.fillStyle = "#7a7f87";
+    ctx.font = "11px sans-serif";
+    ctx.lineWidth = 1;
+    [min, (min + max) / 2, max].forEach(function (v) {
+      ctx.beginPath();
+      ctx.moveTo(left, y(v));
+      ctx.lineTo(width - right, y(v));
+      ctx.stroke();
+      ctx.fillText(v.toFixed(1), 4, y(v) + 4);
+    });
+    ctx.fillText(formatTime(start, range > 86400), left, height - 4);
+    var endLabel = formatTime(now, range > 86400);
+    ctx.fillText(endLabel, width - right - ctx.measureText(endLabel).width, height - 4);
+
+    // Outages are shaded
+    ctx.fillStyle = "rgba(214, 69, 69, 0.12)";
+    outages.forEach(function (o) {
+      var from = Math.max(Date.parse(o.start), start);
+      var to = o.end ? Date.parse(o.end) : o.interrupted ? from : now;
+      if (to > start) { ctx.fillRect(x(from), top, Math.max(x(to) - x(from), 2), height - top - bottom); }
+    });
+
+    ctx.lineWidth = 1.5;
+    series.forEach(function (line) {
+      ctx.strokeStyle = line.color;
+      ctx.beginPath();
+      var last = null;
+      states.forEach(function (s) {
+        var t = Date.parse(s.captured_at);
+        if (s.error || s[line.key] === null || t < start) { last = null; return; }
+        if (last === null) { ctx.moveTo(x(t), y(s[line.key])); } else { ctx.lineTo(x(t), y(s[line.key])); }
+        last = t;
+      });
+      ctx.stroke();
+    });
+  }
+
+  function renderCharts() {
+    chart($("snr"), [{ key: "up_snr_db", color: UP }, { key: "down_snr_db", color: DOWN }]);
+    chart($("loss"), [{ key: "link_loss_db", color: LOSS }]);
+    chart($("rate"), [{ key: "up_rate_mbps", color: UP }, { key: "down_rate_mbps", color: DOWN }]);
+  }
+
+  function renderOutages() {
+    var now = Date.now(), start = now - range * 1000;
+    var timeline = $("timeline"), body = $("outages");
+    timeline.innerHTML = "";
+    body.innerHTML = "";
+    outages.slice().reverse().forEach(function (o) {
+      // It's unknown when an interrupted outage ended
+      var from = Date.parse(o.start), to = o.end ? Date.parse(o.end) : o.interrupted ? from : now;
+      if (to >= start) {
+        var bar = document.createElement("div");
+        bar.style.left = (Math.max(from, start) - start) / (now - start) * 100 + "%";
+        bar.style.width = (to - Math.max(from, start)) / (now - start) * 100 + "%";
+        bar.title = o.cause + " " + formatDuration(to - from);
+        timeline.appendChild(bar);
+      }
+      var row = document.createElement("tr");
+      [formatTime(from, true), o.end ? formatTime(to, true) : o.interrupted ? "?" : "ongoing",
+        o.interrupted ? "?" : formatDuration(to - from), o.cause].forEach(function (text) {
+        var cell = document.createElement("td");
+        cell.textContent = text;
+        row.appendChild(cell);
+      });
+      body.appendChild(row);
+    });
+    if (!outages.length) { body.innerHTML = "<tr><td colspan=4 class=muted>No outages</td></tr>"; }
+  }
+
+  function loadCounters() {
+    getJSON(withRouter("/api/v1/counters")).then(function (counters) {
+      Object.keys(counters).forEach(function (key) { if ($(key)) { $(key).textContent = counters[key]; } });
+    }).catch(function () {});
+  }
+
+  function load() {
+    var from = Math.floor(Date.now() / 1000) - range;
+    var step = Math.max(1, Math.floor(range / 720));
+    getJSON(withRouter("/api/v1/history?from=" + from + "&step=" + step + "s")).then(function (loaded) {
+      states = loaded;
+      $("history-note").textContent = "";
+      renderCharts();
+    }).catch(function (err) {
+      states = [];
+      $("history-note").textContent = err.message;
+      renderCharts();
+    });
+    getJSON(withRouter("/api/v1/outages?from=" + from)).then(function (loaded) {
+      outages = loaded;
+      renderOutages();
+      renderCharts();
+    }).catch(function () {});
+    loadCounters();
+  }
+
+  Array.prototype.forEach.call(document.querySelectorAll(".ranges button"), function (button) {
+    button.addEventListener("click", function () {
+      document.querySelector(".ranges .active").classList.remove("active");
+      button.classList.add("active");
+      range = parseInt(button.getAttribute("data-range"), 10);
+      load();
+    });
+  });
+  window.addEventListener("resize", renderCharts);
+
+  // Routers are only worth choosing between when there are several
+  getJSON("/api/v1/routers").then(function (routers) {
+    if (routers.length < 2) { return; }
+    var select = $("router");
+    routers.forEach(function (r) {
+      var option = document.createElement("option");
+      option.value = option.textContent = r.name;
+      select.appendChild(option);
+    });
+    router = routers[0].name;
+    select.hidden = false;
+    // Outages were loaded for every router
+    load();
+    select.addEventListener("change", function () {
+      router = select.value;
+      states = [];
+      getJSON(withRouter("/api/v1/status")).then(renderCurrent).catch(function () {});
+      load();
+    });
+  }).catch(function () {});
+  getJSON("/api/v1/status").then(renderCurrent).catch(function () {});
+  load();
+
+  var events = new EventSource("/api/v1/stream");
+  events.addEventListener("state", function (e) {
+    var state = JSON.parse(e.data);
+    if (router && state.router !== router) { return; }
+    renderCurrent(state);
+    states.push(state);
+    var start = Date.now() - range * 1000;
+    while (states.length && Date.parse(states[0].captured_at) < start) { states.shift(); }
+    renderCharts();
+  });
+  events.addEventListener("transition", function (e) {
+    if (router && JSON.parse(e.data).router !== router) { return; }
+    var from = Math.floor(Date.now() / 1000) - range;
+    getJSON(withRouter("/api/v1/outages?from=" + from)).then(function (loaded) {
+      outages = loaded;
+      renderOutages();
+    }).catch(function () {});
+    loadCounters();
+  });
+  setInterval(loadCounters, 30000);
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"otecstar/fakebroker"
+)
+
+// runFakeBroker serves a stand-in MQTT broker which logs every message published to it
+func runFakeBroker(args []string) error {
+	flags := flag.NewFlagSet("fake-broker", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:1883", "address to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	broker, err := fakebroker.Listen(*listen)
+	if err != nil {
+		return err
+	}
+	broker.OnMessage = func(m fakebroker.Message) {
+		logger.Info().Str("client", m.ClientID).Str("topic", m.Topic).Bool("retained", m.Retained).
+			Bool("will", m.Will).Msg(string(m.Payload))
+	}
+	logger.Info().Str("broker", broker.URL()).Msg("Fake MQTT broker listening")
+	return broker.Serve()
+}
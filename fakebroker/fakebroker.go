@@ -0,0 +1,303 @@
+// Package fakebroker is a stand-in MQTT 3.1.1 broker, it records what clients publish for development and tests.
+// It understands just enough of the protocol for publishers: no subscriptions, no sessions, no QoS 2.
+package fakebroker
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// MQTT control packet types
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetSubscribe  = 8
+	packetSuback     = 9
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+// Message is a message published to the broker
+type Message struct {
+	ClientID string
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+	// Will is set when the message is the will of a client which went away
+	Will bool
+}
+
+// Broker is a fake MQTT broker. It is safe for concurrent use.
+type Broker struct {
+	listener net.Listener
+	// OnMessage is called with every message, if set before Serve
+	OnMessage func(Message)
+
+	mu       sync.Mutex
+	messages []Message
+	retained map[string]Message
+	clients  map[string]bool // Connected client IDs
+	conns    map[net.Conn]bool
+}
+
+// Listen creates a Broker listening on addr, `127.0.0.1:0` picks a free port
+func Listen(addr string) (*Broker, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Broker{
+		listener: listener,
+		retained: map[string]Message{},
+		clients:  map[string]bool{},
+		conns:    map[net.Conn]bool{},
+	}, nil
+}
+
+// URL is what clients should connect to
+func (b *Broker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// Serve accepts clients until Close is called
+func (b *Broker) Serve() error {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go b.serveConn(conn)
+	}
+}
+
+// Close stops accepting clients
+func (b *Broker) Close() error {
+	return b.listener.Close()
+}
+
+// DropClients closes the connections of all clients as a failing network would, so their wills are published.
+// The broker keeps accepting clients.
+func (b *Broker) DropClients() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for conn := range b.conns {
+		conn.Close()
+	}
+}
+
+// Messages returns all messages published so far, oldest first
+func (b *Broker) Messages() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Message(nil), b.messages...)
+}
+
+// Retained returns the retained message of topic
+func (b *Broker) Retained(topic string) (Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m, ok := b.retained[topic]
+	return m, ok
+}
+
+// Connected tells whether a client with given ID is connected
+func (b *Broker) Connected(clientID string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.clients[clientID]
+}
+
+func (b *Broker) record(m Message) {
+	b.mu.Lock()
+	b.messages = append(b.messages, m)
+	if m.Retained {
+		if len(m.Payload) == 0 {
+			delete(b.retained, m.Topic)
+		} else {
+			b.retained[m.Topic] = m
+		}
+	}
+	onMessage := b.OnMessage
+	b.mu.Unlock()
+	if onMessage != nil {
+		onMessage(m)
+	}
+}
+
+func (b *Broker) serveConn(conn net.Conn) {
+	b.mu.Lock()
+	b.conns[conn] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.conns, conn)
+		b.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+
+	var (
+		clientID string
+		will     *Message
+	)
+	defer func() {
+		if clientID == "" {
+			return
+		}
+		b.mu.Lock()
+		delete(b.clients, clientID)
+		b.mu.Unlock()
+		if will != nil {
+			b.record(*will)
+		}
+	}()
+
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case packetConnect:
+			if clientID, will, err = parseConnect(body); err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.clients[clientID] = true
+			b.mu.Unlock()
+			if _, err := conn.Write([]byte{packetConnack << 4, 2, 0, 0}); err != nil {
+				return
+			}
+		case packetPublish:
+			m, packetID, err := parsePublish(header, body)
+			if err != nil {
+				return
+			}
+			m.ClientID = clientID
+			b.record(m)
+			if m.QoS > 0 {
+				if _, err := conn.Write([]byte{packetPuback << 4, 2, byte(packetID >> 8), byte(packetID)}); err != nil {
+					return
+				}
+			}
+		case packetSubscribe:
+			// Grant nothing, we don't route messages
+			if len(body) < 2 {
+				return
+			}
+			if _, err := conn.Write([]byte{packetSuback << 4, 3, body[0], body[1], 0x80}); err != nil {
+				return
+			}
+		case packetPingreq:
+			if _, err := conn.Write([]byte{packetPingresp << 4, 0}); err != nil {
+				return
+			}
+		case packetDisconnect:
+			// A clean disconnect discards the will
+			will = nil
+			return
+		}
+	}
+}
+
+// readPacket reads the fixed header byte and the rest of a control packet
+func readPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// reader reads MQTT encoded fields from a packet body
+type reader struct {
+	data []byte
+	err  error
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errors.New("packet too short")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) string() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+func parseConnect(body []byte) (string, *Message, error) {
+	r := reader{data: body}
+	_ = r.string() // Protocol name
+	_ = r.bytes(1) // Protocol level
+	flags := r.bytes(1)
+	_ = r.uint16() // Keep alive
+	clientID := r.string()
+	if r.err != nil {
+		return "", nil, r.err
+	}
+
+	var will *Message
+	if flags[0]&0x04 != 0 {
+		will = &Message{
+			ClientID: clientID,
+			Topic:    r.string(),
+			QoS:      (flags[0] >> 3) & 0x03,
+			Retained: flags[0]&0x20 != 0,
+			Will:     true,
+		}
+		will.Payload = append([]byte(nil), r.bytes(int(r.uint16()))...)
+	}
+	return clientID, will, r.err
+}
+
+func parsePublish(header byte, body []byte) (Message, uint16, error) {
+	r := reader{data: body}
+	m := Message{
+		Topic:    r.string(),
+		QoS:      (header >> 1) & 0x03,
+		Retained: header&0x01 != 0,
+	}
+	var packetID uint16
+	if m.QoS > 0 {
+		packetID = r.uint16()
+	}
+	m.Payload = append([]byte(nil), r.data...)
+	return m, packetID, r.err
+}
@@ -0,0 +1,132 @@
+package fakebroker
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"testing"
+	"time"
+)
+
+// startBroker serves a Broker on a free port until the test ends
+func startBroker(t *testing.T) *Broker {
+	broker, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve()
+	t.Cleanup(func() {
+		broker.Close()
+	})
+	return broker
+}
+
+// connect connects a client to broker, with a retained will at will
+func connect(t *testing.T, broker *Broker, clientID, will string) mqtt.Client {
+	options := mqtt.NewClientOptions().
+		AddBroker(broker.URL()).
+		SetClientID(clientID).
+		SetAutoReconnect(false).
+		SetWill(will, "gone", 1, true)
+	client := mqtt.NewClient(options)
+	if token := client.Connect(); !token.WaitTimeout(time.Second*5) || token.Error() != nil {
+		t.Fatalf("Connect() = %v", token.Error())
+	}
+	return client
+}
+
+// publish publishes a message and waits for the broker to take it
+func publish(t *testing.T, client mqtt.Client, topic string, qos byte, retained bool, payload string) {
+	token := client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(time.Second*5) || token.Error() != nil {
+		t.Fatalf("Publish(%s) = %v", topic, token.Error())
+	}
+}
+
+// waitFor polls cond until it holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	broker := startBroker(t)
+	client := connect(t, broker, "publisher", "test/will")
+	if !broker.Connected("publisher") {
+		t.Error("Connected() = false after connecting")
+	}
+
+	publish(t, client, "test/plain", 1, false, "one")
+	publish(t, client, "test/retained", 1, true, "two")
+	// QoS 0 is not acknowledged, the message is there once a later one is
+	publish(t, client, "test/retained", 0, true, "three")
+	publish(t, client, "test/plain", 1, false, "four")
+
+	messages := broker.Messages()
+	want := []Message{
+		{ClientID: "publisher", Topic: "test/plain", Payload: []byte("one"), QoS: 1},
+		{ClientID: "publisher", Topic: "test/retained", Payload: []byte("two"), QoS: 1, Retained: true},
+		{ClientID: "publisher", Topic: "test/retained", Payload: []byte("three"), Retained: true},
+		{ClientID: "publisher", Topic: "test/plain", Payload: []byte("four"), QoS: 1},
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("Messages() = %+v, want %d messages", messages, len(want))
+	}
+	for i, m := range messages {
+		if m.ClientID != want[i].ClientID || m.Topic != want[i].Topic || string(m.Payload) != string(want[i].Payload) ||
+			m.QoS != want[i].QoS || m.Retained != want[i].Retained || m.Will {
+			t.Errorf("Messages()[%d] = %+v, want %+v", i, m, want[i])
+		}
+	}
+
+	if m, ok := broker.Retained("test/retained"); !ok || string(m.Payload) != "three" {
+		t.Errorf("Retained(test/retained) = %q, %v, want the latest retained message", m.Payload, ok)
+	}
+	if _, ok := broker.Retained("test/plain"); ok {
+		t.Error("Retained(test/plain) found a message which was not retained")
+	}
+	publish(t, client, "test/retained", 1, true, "")
+	if _, ok := broker.Retained("test/retained"); ok {
+		t.Error("Retained(test/retained) found a message after an empty one cleared it")
+	}
+}
+
+func TestDisconnectDiscardsWill(t *testing.T) {
+	broker := startBroker(t)
+	client := connect(t, broker, "leaving", "test/will")
+	client.Disconnect(250)
+
+	waitFor(t, "the client to go", func() bool {
+		return !broker.Connected("leaving")
+	})
+	if _, ok := broker.Retained("test/will"); ok {
+		t.Error("will published after a clean disconnect")
+	}
+}
+
+func TestDropClientsPublishesWills(t *testing.T) {
+	broker := startBroker(t)
+	connect(t, broker, "dropped", "test/will")
+	broker.DropClients()
+
+	waitFor(t, "the will", func() bool {
+		_, ok := broker.Retained("test/will")
+		return ok
+	})
+	m, _ := broker.Retained("test/will")
+	if !m.Will || m.ClientID != "dropped" || string(m.Payload) != "gone" || m.QoS != 1 {
+		t.Errorf("Retained(test/will) = %+v, want the will of the dropped client", m)
+	}
+	if broker.Connected("dropped") {
+		t.Error("Connected() = true after dropping the client")
+	}
+
+	// The broker still takes clients
+	connect(t, broker, "again", "test/will")
+	if !broker.Connected("again") {
+		t.Error("Connected() = false for a client connecting after the drop")
+	}
+}
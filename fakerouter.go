@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"otecstar/router/fakerouter"
+)
+
+// runFakeRouter serves a fake OTECStar router, so the app can be developed without a device
+func runFakeRouter(args []string) error {
+	flags := flag.NewFlagSet("fake-router", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8123", "address to listen on, use it as router_ip")
+	username := flags.String("username", "admin", "username accepted by the fake router")
+	password := flags.String("password", "admin", "password accepted by the fake router")
+	down := flags.Bool("down", false, "start with the line down")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	r := fakerouter.New(*username, *password)
+	r.SetDown(*down)
+	logger.Info().Str("router_ip", *listen).Msg("Fake router listening, script it with POST /_fake/{expire,down,unreachable,malformed,delay,status}")
+	return http.ListenAndServe(*listen, r)
+}
@@ -0,0 +1,29 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// defaultGateway reads the gateway of the default route from `route get`, as of macOS and the BSDs
+func defaultGateway() (net.IP, error) {
+	out, err := exec.Command("route", "-n", "get", "default").Output()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		key := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(key) != 2 || key[0] != "gateway" {
+			continue
+		}
+		if ip := net.ParseIP(strings.TrimSpace(key[1])).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no default route")
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// defaultGateway reads the gateway of the default route from `route print`
+func defaultGateway() (net.IP, error) {
+	out, err := exec.Command("route", "print", "0.0.0.0").Output()
+	if err != nil {
+		return nil, err
+	}
+	// Network Destination, Netmask, Gateway, Interface, Metric
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "0.0.0.0" || fields[1] != "0.0.0.0" {
+			continue
+		}
+		if ip := net.ParseIP(fields[2]).To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("no default route")
+}
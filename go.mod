@@ -5,9 +5,15 @@ go 1.14
 require (
 	github.com/PuerkitoBio/goquery v1.5.1
 	github.com/akavel/rsrc v0.9.0 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.2.0
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/getlantern/systray v0.0.0-20200324212034-d3ab4fd25d99
+	github.com/godbus/dbus/v5 v5.0.3
 	github.com/magefile/mage v1.9.0
 	github.com/rs/zerolog v1.18.0
+	github.com/zalando/go-keyring v0.1.1
 	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 	gopkg.in/ini.v1 v1.54.0
 )
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"otecstar/router"
+	"strconv"
+)
+
+// Health is the overall judgement of a captured state, it also names the tray icon to show
+type Health string
+
+const (
+	HealthOK    Health = "ok"
+	HealthWarn  Health = "warn"
+	HealthError Health = "error"
+)
+
+// State is a state captured from a router, along with how the application judged it
+type State struct {
+	router.State
+	// Health and Reason are set by Rules.Judge, Health is empty until then
+	Health Health
+	Reason string
+}
+
+// newState wraps a captured state, not judged yet
+func newState(captured *router.State) *State {
+	return &State{State: *captured}
+}
+
+// stateJudgement is what State adds to the JSON of router.State
+type stateJudgement struct {
+	Health Health `json:"health,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// MarshalJSON encodes s as the flat object of router.State, with `health` and `reason` once judged
+func (s State) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(s.State)
+	if err != nil {
+		return nil, err
+	}
+	if s.Health == "" && s.Reason == "" {
+		return data, nil
+	}
+	judgement, err := json.Marshal(stateJudgement{Health: s.Health, Reason: s.Reason})
+	if err != nil {
+		return nil, err
+	}
+	// Both are objects, joined by their members
+	return append(append(data[:len(data)-1], ','), judgement[1:]...), nil
+}
+
+// UnmarshalJSON decodes what MarshalJSON produces
+func (s *State) UnmarshalJSON(data []byte) error {
+	var judgement stateJudgement
+	if err := json.Unmarshal(data, &s.State); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &judgement); err != nil {
+		return err
+	}
+	s.Health, s.Reason = judgement.Health, judgement.Reason
+	return nil
+}
+
+// Evaluate gives the health of a state, as judged by Rules when the state went through them
+func Evaluate(state *State) Health {
+	if state.Health != "" {
+		return state.Health
+	}
+	return judgeReadings(state)
+}
+
+// judgeReadings is the judgement without rules: error when WAN or link is not connected, warn when a reading is zero.
+// Unknown readings don't warn, they are NaN.
+func judgeReadings(state *State) Health {
+	if !state.OK() {
+		return HealthError
+	}
+	if state.LinkLoss == 0 || state.UpSNR == 0 || state.DownSNR == 0 {
+		return HealthWarn
+	}
+	return HealthOK
+}
+
+// Description is a short English sentence describing the health
+func (h Health) Description() string {
+	switch h {
+	case HealthOK:
+		return "network OK"
+	case HealthWarn:
+		return "network unstable"
+	default:
+		return "network disconnected"
+	}
+}
+
+// describeState is the Description of the health of state, along with the rules which fired.
+// While polling is paused by the Breaker, it tells why and until when instead.
+func describeState(state *State) string {
+	var paused *PausedError
+	if errors.As(state.Err, &paused) {
+		return paused.Summary()
+	}
+	description := Evaluate(state).Description()
+	if state.Reason != "" {
+		description += " (" + state.Reason + ")"
+	}
+	return description
+}
+
+// connStateText gives the text the router itself uses for a ConnState
+func connStateText(s router.ConnState) string {
+	switch s {
+	case router.Connected:
+		return "连接上"
+	case router.Disconnected:
+		return "未连接"
+	default:
+		return "-"
+	}
+}
+
+// formatNumber formats a reading the same way as the router shows it, `-` when it's unknown
+func formatNumber(v float64) string {
+	if math.IsNaN(v) {
+		return "-"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// marshalState encodes state as JSON, with its Health as `health` even if it was not judged by Rules
+func marshalState(state *State) ([]byte, error) {
+	judged := *state
+	judged.Health = Evaluate(state)
+	return json.Marshal(&judged)
+}
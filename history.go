@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// compactInterval is how often History applies retention and downsampling
+const compactInterval = time.Hour
+
+// firstCompactDelay is how long after opening History compacts the first time, so that it does not slow
+// starting up
+const firstCompactDelay = time.Minute
+
+// compactMu serializes compaction of every History
+var compactMu sync.Mutex
+
+// History is an append-only store of captured states of every router, one JSON object per line, oldest first.
+// There is a single History of a path, since compaction replaces the file: it's kept across reloads.
+type History struct {
+	mu          sync.Mutex
+	config      *HistoryConfig
+	file        *os.File
+	lastCompact time.Time
+	compacting  bool
+	compactions sync.WaitGroup
+}
+
+// OpenHistory opens (or creates) the store at config.Path. Retention and downsampling are applied in
+// background, shortly after and then every compactInterval.
+func OpenHistory(config *HistoryConfig) (*History, error) {
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &History{
+		config:      config,
+		file:        file,
+		lastCompact: time.Now().Add(firstCompactDelay - compactInterval),
+	}, nil
+}
+
+// Reconfigure applies the retention and downsampling of config from the next compaction on, its path
+// has to be the same
+func (h *History) Reconfigure(config *HistoryConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = config
+}
+
+// Consume appends a captured state, it's meant to be a Poller consumer. Compaction is started in background,
+// so polling never waits for it.
+func (h *History) Consume(state *State) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to encode state for history")
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return
+	}
+	if _, err := h.file.Write(append(data, '\n')); err != nil {
+		logger.Error().Err(err).Msg("Failed to append state to history")
+	}
+	if now := time.Now(); !h.compacting && now.Sub(h.lastCompact) >= compactInterval {
+		h.compacting, h.lastCompact = true, now
+		h.compactions.Add(1)
+		go func() {
+			defer h.compactions.Done()
+			if err := h.compact(now); err != nil {
+				logger.Error().Err(err).Msg("Failed to compact history")
+			}
+		}()
+	}
+}
+
+// Range returns the states captured in [from, to], oldest first. A zero `to` means no upper bound.
+// The store is read without blocking Consume, states appended meanwhile are left out.
+func (h *History) Range(from, to time.Time) ([]*State, error) {
+	h.mu.Lock()
+	f, size, err := h.snapshot()
+	h.mu.Unlock()
+	if err != nil || f == nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var states []*State
+	err = each(io.LimitReader(f, size), func(state *State) {
+		if state.CapturedAt.Before(from) || (!to.IsZero() && state.CapturedAt.After(to)) {
+			return
+		}
+		states = append(states, state)
+	})
+	return states, err
+}
+
+// Close closes the store, further states are dropped. It waits for a running compaction.
+func (h *History) Close() error {
+	h.mu.Lock()
+	var err error
+	if h.file != nil {
+		err = h.file.Close()
+		h.file = nil
+	}
+	h.mu.Unlock()
+	h.compactions.Wait()
+	return err
+}
+
+// snapshot opens the store for reading along with its size, it's called with mu held. Reading that much
+// of it gives whole lines, since later states are appended and compaction replaces the file instead of
+// changing it. The file is nil when the store does not exist yet.
+func (h *History) snapshot() (*os.File, int64, error) {
+	f, err := os.Open(h.config.Path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// each calls fn with every state read from r, lines that fail to decode are skipped
+func each(r io.Reader, fn func(state *State)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var state State
+		if err := json.Unmarshal(scanner.Bytes(), &state); err != nil {
+			logger.Debug().Err(err).Msg("Skipped bad history line")
+			continue
+		}
+		fn(&state)
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the store without states beyond retention, and thins states older than DownsampleAfter.
+// States whose health differs from the previous kept one of their router are always kept, so outages stay visible.
+// The states there are when it starts are compacted without holding mu, the ones appended meanwhile are then
+// copied as they are.
+func (h *History) compact(now time.Time) error {
+	compactMu.Lock()
+	defer compactMu.Unlock()
+
+	h.mu.Lock()
+	config := h.config
+	src, size, err := h.snapshot()
+	h.mu.Unlock()
+	if err != nil {
+		h.compacted()
+		return err
+	}
+
+	tmpPath := config.Path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		if src != nil {
+			src.Close()
+		}
+		h.compacted()
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+
+	var (
+		kept, dropped int
+		// By router
+		lastKept   = map[string]time.Time{}
+		lastHealth = map[string]Health{}
+	)
+	if src != nil {
+		err = each(io.LimitReader(src, size), func(state *State) {
+			age := now.Sub(state.CapturedAt)
+			health := Evaluate(state)
+			switch {
+			case config.Retention > 0 && age > config.Retention:
+				dropped++
+				return
+			case config.DownsampleAfter > 0 && age > config.DownsampleAfter &&
+				health == lastHealth[state.Router] && state.CapturedAt.Sub(lastKept[state.Router]) < config.DownsampleInterval:
+				dropped++
+				return
+			}
+			if err := encoder.Encode(state); err != nil {
+				logger.Error().Err(err).Msg("Failed to write history")
+				return
+			}
+			kept++
+			lastKept[state.Router], lastHealth[state.Router] = state.CapturedAt, health
+		})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.compacting = false
+	// States appended since the snapshot follow, src reads on where compacting stopped
+	if err == nil && src != nil {
+		_, err = io.Copy(writer, src)
+	}
+	if src != nil {
+		src.Close()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	// Windows does not replace files which are open
+	closed := h.file == nil
+	if !closed {
+		if closeErr := h.file.Close(); err == nil {
+			err = closeErr
+		}
+		h.file = nil
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, config.Path)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
+	if closed {
+		return err
+	}
+
+	// Keep appending even if compaction failed
+	file, openErr := os.OpenFile(config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if openErr != nil {
+		return openErr
+	}
+	h.file = file
+	logger.Debug().Int("kept", kept).Int("dropped", dropped).Msg("History compacted")
+	return err
+}
+
+// compacted marks compaction over when it failed early
+func (h *History) compacted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.compacting = false
+}
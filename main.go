@@ -1,41 +1,107 @@
 package main
 
 import (
-	"github.com/getlantern/systray"
+	"flag"
+	"fmt"
 	"github.com/rs/zerolog"
 	zlog "github.com/rs/zerolog/log"
+	"io"
 	"os"
 	"time"
 )
 
+const VERSION = "v0.2.1"
+
 var logger zerolog.Logger
 
+// unsafeLogSecrets turns off masking secrets in logs, set by the global --unsafe-log-secrets flag
+var unsafeLogSecrets bool
+
 func init() {
-	zlog.Logger = zlog.Output(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339})
+	setLogOutput(os.Stdout)
+}
+
+// setLogOutput sends logs of all modules to w, loggers made before keep writing where they did.
+// Secrets are masked unless unsafeLogSecrets is set.
+func setLogOutput(w io.Writer) {
+	var out io.Writer = zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339}
+	if !unsafeLogSecrets {
+		out = redactWriter{next: out}
+	}
+	zlog.Logger = zlog.Output(out)
 	logger = zlog.Logger.With().Str("module", "main").Logger()
 }
 
-func main() {
-	systray.Run(onReady, onExit)
+// exitStatus is returned by commands which report by themselves, and only need to exit with a status
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
 }
 
-func onReady() {
-	config, err := LoadConfig()
-	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to load config file")
+// commands are the sub commands, given as the first argument. Without one the tray app runs.
+var commands = map[string]func(args []string) error{
+	"config":       runConfig,
+	"daemon":       runDaemon,
+	"fake-broker":  runFakeBroker,
+	"fake-router":  runFakeRouter,
+	"outages":      runOutages,
+	"set-password": runSetPassword,
+	"setup":        runSetup,
+	"watch":        runWatch,
+	"status":       runStatus,
+}
+
+func main() {
+	for i, arg := range os.Args[1:] {
+		if arg == "--unsafe-log-secrets" || arg == "-unsafe-log-secrets" {
+			os.Args = append(os.Args[:i+1], os.Args[i+2:]...)
+			unsafeLogSecrets = true
+			setLogOutput(os.Stdout)
+			logger.Warn().Msg("Secrets are logged unmasked, don't share these logs")
+			break
+		}
+	}
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			err := command(os.Args[2:])
+			if status, ok := err.(exitStatus); ok {
+				os.Exit(int(status))
+			}
+			if err != nil {
+				logger.Fatal().Err(err).Str("command", os.Args[1]).Msg("Command failed")
+			}
+			return
+		}
 	}
 
-	// Set log level
-	if lvl, err := zerolog.ParseLevel(config.LogLevel); err != nil {
-		logger.Warn().Err(err).Str("log_level", config.LogLevel).Msg("Unknown log level")
-	} else {
-		zerolog.SetGlobalLevel(lvl)
+	flags := flag.NewFlagSet("otecstar", flag.ExitOnError)
+	addConfigFlags(flags)
+	_ = flags.Parse(os.Args[1:])
+	if flags.NArg() > 0 {
+		logger.Fatal().Str("command", flags.Arg(0)).Msg("Unknown command")
 	}
+	runTray()
+}
 
-	_ = NewOTECStarApp(&config)
-	logger.Info().Msg("Ready")
+// prepare loads the config file, and applies the log level in it
+func prepare() (*Config, error) {
+	config, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	applyLogging(&config)
+	return &config, nil
 }
 
-func onExit() {
-	logger.Info().Msg("Quit")
+// applyLogging sets the log level of config, and masks its passwords and usernames in logs
+func applyLogging(config *Config) {
+	secrets := []string{config.Username, config.Password, config.MQTT.Username, config.MQTT.Password}
+	for _, router := range config.Routers {
+		secrets = append(secrets, router.Username, router.Password)
+	}
+	setRedactedValues(secrets...)
+	// log_level is validated by LoadConfig
+	lvl, _ := zerolog.ParseLevel(config.LogLevel)
+	zerolog.SetGlobalLevel(lvl)
 }
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"otecstar/router"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// scrapeDurationBuckets are upper bounds (in seconds) of the scrape duration histogram
+var scrapeDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics exports captured states in Prometheus text format, every sample is labeled with its router
+type Metrics struct {
+	mu      sync.Mutex
+	routers []*routerMetrics // In the order of the config
+}
+
+// routerMetrics are the metrics of a router
+type routerMetrics struct {
+	name   string
+	client *router.Client
+
+	state          *State // Last successful one
+	lastFailed     bool
+	health         Health // Of the last state
+	pausedUntil    time.Time
+	scrapeFailures uint64
+	durationCounts []uint64 // Per bucket, not cumulative
+	durationSum    float64
+	durationCount  uint64
+}
+
+// NewMetrics constructs Metrics of the routers of given names, which also reports the counters of their clients
+func NewMetrics(names []string, clients []*router.Client) *Metrics {
+	m := Metrics{}
+	for i, name := range names {
+		m.routers = append(m.routers, &routerMetrics{
+			name:           name,
+			client:         clients[i],
+			durationCounts: make([]uint64, len(scrapeDurationBuckets)),
+		})
+	}
+	return &m
+}
+
+// router finds the metrics of the router of given name, an empty name is the first router
+func (m *Metrics) router(name string) *routerMetrics {
+	for _, r := range m.routers {
+		if r.name == name || name == "" {
+			return r
+		}
+	}
+	return nil
+}
+
+// Consume records a captured state, it's meant to be a Poller consumer
+func (m *Metrics) Consume(state *State) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := m.router(state.Router)
+	if r == nil {
+		return
+	}
+	r.health = Evaluate(state)
+	r.pausedUntil = time.Time{}
+	var paused *PausedError
+	if errors.As(state.Err, &paused) {
+		r.pausedUntil = paused.Until
+	}
+	r.lastFailed = state.Err != nil
+	if r.lastFailed {
+		r.scrapeFailures++
+	} else {
+		r.state = state
+	}
+
+	seconds := state.RoundTrip.Seconds()
+	r.durationSum += seconds
+	r.durationCount++
+	if i := sort.SearchFloat64s(scrapeDurationBuckets, seconds); i < len(scrapeDurationBuckets) {
+		r.durationCounts[i]++
+	}
+}
+
+// Counters are the counters of Metrics
+type Counters struct {
+	router.Stats
+	ScrapeFailures uint64 `json:"scrape_failures"`
+	Scrapes        uint64 `json:"scrapes"`
+}
+
+// Counters returns the counters of the router of given name so far, an empty name is the first router.
+// ok is false when there is no such router.
+func (m *Metrics) Counters(name string) (counters Counters, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.router(name)
+	if r == nil {
+		return Counters{}, false
+	}
+	return Counters{
+		Stats:          r.client.Stats(),
+		ScrapeFailures: r.scrapeFailures,
+		Scrapes:        r.durationCount,
+	}, true
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := map[*routerMetrics]router.Stats{}
+	for _, r := range m.routers {
+		stats[r] = r.client.Stats()
+	}
+	// metric writes a metric with a sample per router, leaving out routers without a value
+	metric := func(name, kind, help string, value func(r *routerMetrics) (float64, bool)) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, r := range m.routers {
+			if v, ok := value(r); ok {
+				fmt.Fprintf(w, "%s{router=%q} %s\n", name, r.name, formatFloat(v))
+			}
+		}
+	}
+	// reading writes a metric of the last successful state, unknown readings are left out
+	reading := func(name, help string, value func(state *State) float64) {
+		metric(name, "gauge", help, func(r *routerMetrics) (float64, bool) {
+			if r.state == nil {
+				return 0, false
+			}
+			v := value(r.state)
+			return v, !math.IsNaN(v)
+		})
+	}
+	always := func(value func(r *routerMetrics) float64) func(r *routerMetrics) (float64, bool) {
+		return func(r *routerMetrics) (float64, bool) {
+			return value(r), true
+		}
+	}
+
+	reading("otecstar_wan_up", "Whether the WAN is connected.", func(s *State) float64 { return boolValue(s.WAN == router.Connected) })
+	reading("otecstar_link_up", "Whether the link is connected.", func(s *State) float64 { return boolValue(s.Link == router.Connected) })
+	reading("otecstar_link_attenuation_db", "Link attenuation in dB.", func(s *State) float64 { return s.LinkLoss })
+	reading("otecstar_upstream_rate_mbps", "Upstream sync rate in Mbps.", func(s *State) float64 { return s.UpRate })
+	reading("otecstar_downstream_rate_mbps", "Downstream sync rate in Mbps.", func(s *State) float64 { return s.DownRate })
+	reading("otecstar_upstream_snr_db", "Upstream signal-to-noise ratio in dB.", func(s *State) float64 { return s.UpSNR })
+	reading("otecstar_downstream_snr_db", "Downstream signal-to-noise ratio in dB.", func(s *State) float64 { return s.DownSNR })
+	reading("otecstar_last_success_timestamp_seconds", "When the last successful scrape happened.",
+		func(s *State) float64 { return float64(s.CapturedAt.UnixNano()) / 1e9 })
+
+	metric("otecstar_scrape_success", "gauge", "Whether the last scrape succeeded, other gauges keep values of the last successful one.",
+		always(func(r *routerMetrics) float64 { return boolValue(r.state != nil && !r.lastFailed) }))
+	fmt.Fprintf(w, "# HELP otecstar_health Health of the network as judged by rules, 1 for the current one.\n")
+	fmt.Fprintf(w, "# TYPE otecstar_health gauge\n")
+	for _, r := range m.routers {
+		if r.health == "" {
+			continue
+		}
+		for _, health := range []Health{HealthOK, HealthWarn, HealthError} {
+			fmt.Fprintf(w, "otecstar_health{router=%q,health=%q} %s\n", r.name, health, formatFloat(boolValue(health == r.health)))
+		}
+	}
+	metric("otecstar_login_attempts_total", "counter", "Login attempts.",
+		always(func(r *routerMetrics) float64 { return float64(stats[r].LoginAttempts) }))
+	metric("otecstar_login_failures_total", "counter", "Failed login attempts.",
+		always(func(r *routerMetrics) float64 { return float64(stats[r].LoginFailures) }))
+	metric("otecstar_session_expiries_total", "counter", "Sessions found expired by the router.",
+		always(func(r *routerMetrics) float64 { return float64(stats[r].SessionExpiries) }))
+	metric("otecstar_scrape_failures_total", "counter", "Failed scrapes of the WAN page.",
+		always(func(r *routerMetrics) float64 { return float64(r.scrapeFailures) }))
+	fmt.Fprintf(w, "# HELP otecstar_fetch_failures_total Failed fetches of the WAN page by kind, including retried ones.\n")
+	fmt.Fprintf(w, "# TYPE otecstar_fetch_failures_total counter\n")
+	for _, r := range m.routers {
+		for _, failures := range []struct {
+			kind  string
+			count uint64
+		}{
+			{router.FailureNetwork, stats[r].NetworkFailures},
+			{router.FailureAuth, stats[r].AuthFailures},
+			{router.FailureSession, stats[r].SessionFailures},
+			{router.FailureFormat, stats[r].FormatFailures},
+		} {
+			fmt.Fprintf(w, "otecstar_fetch_failures_total{router=%q,kind=%q} %d\n", r.name, failures.kind, failures.count)
+		}
+	}
+	now := time.Now()
+	metric("otecstar_polling_paused", "gauge", "Whether polling is paused after failures in a row.",
+		always(func(r *routerMetrics) float64 { return boolValue(now.Before(r.pausedUntil)) }))
+
+	fmt.Fprintf(w, "# HELP otecstar_scrape_duration_seconds Duration of scrapes, including logins.\n")
+	fmt.Fprintf(w, "# TYPE otecstar_scrape_duration_seconds histogram\n")
+	for _, r := range m.routers {
+		var cumulative uint64
+		for i, bound := range scrapeDurationBuckets {
+			cumulative += r.durationCounts[i]
+			fmt.Fprintf(w, "otecstar_scrape_duration_seconds_bucket{router=%q,le=%q} %d\n", r.name, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "otecstar_scrape_duration_seconds_bucket{router=%q,le=\"+Inf\"} %d\n", r.name, r.durationCount)
+		fmt.Fprintf(w, "otecstar_scrape_duration_seconds_sum{router=%q} %s\n", r.name, formatFloat(r.durationSum))
+		fmt.Fprintf(w, "otecstar_scrape_duration_seconds_count{router=%q} %d\n", r.name, r.durationCount)
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
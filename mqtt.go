@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"strings"
+	"sync"
+	"time"
+)
+
+// haSensor describes a Home Assistant entity made from a field of the state topic
+type haSensor struct {
+	component   string // sensor or binary_sensor
+	key         string
+	name        string
+	template    string
+	unit        string
+	deviceClass string
+}
+
+// haSensors are announced through Home Assistant MQTT discovery, one per field of State
+var haSensors = []haSensor{
+	{"binary_sensor", "wan", "WAN", "{{ 'ON' if value_json.wan == 'connected' else 'OFF' }}", "", "connectivity"},
+	{"binary_sensor", "link", "Link", "{{ 'ON' if value_json.link == 'connected' else 'OFF' }}", "", "connectivity"},
+	{"sensor", "health", "Health", "{{ value_json.health }}", "", ""},
+	{"sensor", "link_loss", "Attenuation", "{{ value_json.link_loss_db }}", "dB", ""},
+	{"sensor", "up_rate", "Upstream rate", "{{ value_json.up_rate_mbps }}", "Mbit/s", ""},
+	{"sensor", "down_rate", "Downstream rate", "{{ value_json.down_rate_mbps }}", "Mbit/s", ""},
+	{"sensor", "up_snr", "Upstream SNR", "{{ value_json.up_snr_db }}", "dB", ""},
+	{"sensor", "down_snr", "Downstream SNR", "{{ value_json.down_snr_db }}", "dB", ""},
+	{"sensor", "round_trip", "Scrape duration", "{{ value_json.round_trip_seconds }}", "s", ""},
+	{"sensor", "captured_at", "Captured at", "{{ value_json.captured_at }}", "", "timestamp"},
+	{"sensor", "error", "Error", "{{ value_json.error | default('') }}", "", ""},
+}
+
+// MQTTPublisher publishes every captured state to an MQTT broker as retained messages,
+// and announces them to Home Assistant through MQTT discovery, as a device per router
+type MQTTPublisher struct {
+	config *MQTTConfig
+	nodes  map[string]string // Identify routers in topics, by router name. Config keeps them apart.
+	names  []string          // Of routers, in the order of the config
+	// availability is the topic telling whether we are online. It's of the router when there is a single one,
+	// since the broker only takes a single will.
+	availability string
+	client       mqtt.Client
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// NewMQTTPublisher constructs a MQTTPublisher of routers and starts connecting to the broker in background
+func NewMQTTPublisher(config *MQTTConfig, routers []*RouterConfig) *MQTTPublisher {
+	p := MQTTPublisher{
+		config: config,
+		nodes:  map[string]string{},
+		stopCh: make(chan struct{}),
+	}
+	// Names are unique, while routers at different places often share the default router_ip
+	for _, router := range routers {
+		p.nodes[router.Name] = topicSafe(router.Name)
+		p.names = append(p.names, router.Name)
+	}
+	p.availability = fmt.Sprintf("%s/availability", config.TopicPrefix)
+	if len(routers) == 1 {
+		p.availability = p.topic(routers[0].Name, "availability")
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(time.Minute).
+		SetConnectTimeout(time.Second*10).
+		SetWill(p.availability, "offline", byte(config.QoS), true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Warn().Err(err).Msg("MQTT connection lost")
+		})
+	p.client = mqtt.NewClient(options)
+	go p.connect()
+	return &p
+}
+
+// connect retries until the first connection succeeds, after that the client reconnects by itself
+func (p *MQTTPublisher) connect() {
+	backoff := time.Duration(0)
+	for {
+		token := p.client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			return
+		}
+		backoff = nextBackoff(backoff, time.Minute)
+		logger.Warn().Err(token.Error()).Str("broker", p.config.Broker).Dur("retryIn", backoff).Msg("Failed to connect MQTT broker")
+		select {
+		case <-p.stopCh:
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+func (p *MQTTPublisher) onConnect(mqtt.Client) {
+	logger.Info().Str("broker", p.config.Broker).Msg("MQTT connected")
+	p.publish(p.availability, "online")
+	if p.config.Discovery {
+		for _, name := range p.names {
+			p.announce(name)
+		}
+	}
+}
+
+// announce publishes Home Assistant discovery configs of the router of given name
+func (p *MQTTPublisher) announce(name string) {
+	node := p.nodes[name]
+	device := map[string]interface{}{
+		"identifiers":  []string{"otecstar_" + node},
+		"name":         "OTECStar " + name,
+		"manufacturer": "OTECStar",
+		"sw_version":   VERSION,
+	}
+	for _, sensor := range haSensors {
+		config := map[string]interface{}{
+			"name":               fmt.Sprintf("OTECStar %s %s", name, sensor.name),
+			"unique_id":          fmt.Sprintf("otecstar_%s_%s", node, sensor.key),
+			"state_topic":        p.topic(name, "state"),
+			"value_template":     sensor.template,
+			"availability_topic": p.availability,
+			"device":             device,
+		}
+		if sensor.unit != "" {
+			config["unit_of_measurement"] = sensor.unit
+		}
+		if sensor.deviceClass != "" {
+			config["device_class"] = sensor.deviceClass
+		}
+		payload, _ := json.Marshal(config)
+		p.publish(fmt.Sprintf("%s/%s/otecstar_%s/%s/config", p.config.DiscoveryPrefix, sensor.component, node, sensor.key), string(payload))
+	}
+}
+
+// Consume publishes a captured state, it's meant to be a Poller consumer
+func (p *MQTTPublisher) Consume(state *State) {
+	if _, ok := p.nodes[state.Router]; !ok || !p.client.IsConnectionOpen() {
+		return
+	}
+	data, err := marshalState(state)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to encode state for MQTT")
+		return
+	}
+	p.publish(p.topic(state.Router, "state"), string(data))
+}
+
+// Close publishes offline availability and disconnects
+func (p *MQTTPublisher) Close() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+	})
+	if p.client.IsConnectionOpen() {
+		// Waited for, so that it's delivered. A publish still in flight also holds up Disconnect until
+		// its waiter in publish times out.
+		p.client.Publish(p.availability, byte(p.config.QoS), true, "offline").WaitTimeout(time.Second * 2)
+	}
+	p.client.Disconnect(250)
+}
+
+// publish sends a retained message without waiting for it to be delivered
+func (p *MQTTPublisher) publish(topic, payload string) {
+	token := p.client.Publish(topic, byte(p.config.QoS), true, payload)
+	go func() {
+		if token.WaitTimeout(time.Second*10) && token.Error() != nil {
+			logger.Error().Err(token.Error()).Str("topic", topic).Msg("Failed to publish MQTT message")
+		}
+	}()
+}
+
+// topic is a topic of the router of given name, like {topic_prefix}/{node}/state
+func (p *MQTTPublisher) topic(router, name string) string {
+	return fmt.Sprintf("%s/%s/%s", p.config.TopicPrefix, p.nodes[router], name)
+}
+
+// topicSafe replaces characters which are not welcome in MQTT topics and Home Assistant IDs
+func topicSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
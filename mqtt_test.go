@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"otecstar/fakebroker"
+	"otecstar/router"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startMQTT serves a fake broker, and connects a MQTTPublisher of routers of given names to it
+func startMQTT(t *testing.T, names ...string) (*MQTTPublisher, *fakebroker.Broker) {
+	broker, err := fakebroker.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve()
+	t.Cleanup(func() {
+		broker.Close()
+	})
+
+	config := defaultConfig().MQTT
+	config.Broker = broker.URL()
+	config.QoS = 1
+	var routers []*RouterConfig
+	for _, name := range names {
+		routers = append(routers, &RouterConfig{Name: name, AuthConfig: &AuthConfig{RouterIP: "192.168.123.1"}})
+	}
+	p := NewMQTTPublisher(&config, routers)
+	t.Cleanup(p.Close)
+	waitFor(t, "the publisher to connect", func() bool {
+		return broker.Connected(config.ClientID) && p.client.IsConnectionOpen()
+	})
+	return p, broker
+}
+
+// waitFor polls cond until it holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second * 5); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// waitRetained waits for the retained message of topic to be payload
+func waitRetained(t *testing.T, broker *fakebroker.Broker, topic, payload string) fakebroker.Message {
+	t.Helper()
+	var m fakebroker.Message
+	waitFor(t, topic+" to be "+payload, func() bool {
+		var ok bool
+		m, ok = broker.Retained(topic)
+		return ok && string(m.Payload) == payload
+	})
+	return m
+}
+
+func TestMQTTPublishesRetainedState(t *testing.T) {
+	p, broker := startMQTT(t, "office")
+	waitRetained(t, broker, "otecstar/office/availability", "online")
+
+	state := &State{
+		State: router.State{
+			WANStatus:  router.WANStatus{WAN: router.Connected, Link: router.Connected, DownSNR: 11.2},
+			Router:     "office",
+			CapturedAt: time.Now(),
+		},
+		Health: HealthOK,
+	}
+	p.Consume(state)
+	// States of routers which are not ours are dropped
+	p.Consume(&State{State: router.State{Router: "elsewhere"}})
+
+	var m fakebroker.Message
+	waitFor(t, "the state", func() bool {
+		var ok bool
+		m, ok = broker.Retained("otecstar/office/state")
+		return ok
+	})
+	var published struct {
+		Router  string  `json:"router"`
+		WAN     string  `json:"wan"`
+		DownSNR float64 `json:"down_snr_db"`
+		Health  string  `json:"health"`
+	}
+	if err := json.Unmarshal(m.Payload, &published); err != nil {
+		t.Fatalf("state is not JSON: %v: %s", err, m.Payload)
+	}
+	if published.Router != "office" || published.WAN != "connected" || published.DownSNR != 11.2 || published.Health != "ok" {
+		t.Errorf("published state = %s", m.Payload)
+	}
+	if m.QoS != 1 {
+		t.Errorf("state QoS = %d, want 1", m.QoS)
+	}
+	for _, m := range broker.Messages() {
+		if strings.Contains(m.Topic, "elsewhere") {
+			t.Errorf("published %s of a router which is not configured", m.Topic)
+		}
+	}
+}
+
+func TestMQTTAvailability(t *testing.T) {
+	p, broker := startMQTT(t, "office")
+	waitRetained(t, broker, "otecstar/office/availability", "online")
+
+	p.Close()
+	m := waitRetained(t, broker, "otecstar/office/availability", "offline")
+	if m.Will {
+		t.Error("offline was left to the will when closing")
+	}
+}
+
+func TestMQTTSharesAvailabilityOfRouters(t *testing.T) {
+	_, broker := startMQTT(t, "office", "home")
+	waitRetained(t, broker, "otecstar/availability", "online")
+	for _, topic := range []string{"otecstar/office/availability", "otecstar/home/availability"} {
+		if _, ok := broker.Retained(topic); ok {
+			t.Errorf("published %s with several routers", topic)
+		}
+	}
+}
+
+func TestMQTTReconnects(t *testing.T) {
+	_, broker := startMQTT(t, "office")
+	waitRetained(t, broker, "otecstar/office/availability", "online")
+
+	broker.DropClients()
+	waitFor(t, "the will", func() bool {
+		for _, m := range broker.Messages() {
+			if m.Will && m.Topic == "otecstar/office/availability" && string(m.Payload) == "offline" && m.Retained {
+				return true
+			}
+		}
+		return false
+	})
+
+	// Back online, with discovery announced again
+	waitFor(t, "the publisher to reconnect", func() bool {
+		return broker.Connected("otecstar")
+	})
+	m := waitRetained(t, broker, "otecstar/office/availability", "online")
+	if m.Will {
+		t.Error("online is the will")
+	}
+	waitFor(t, "discovery to be announced again", func() bool {
+		announced := 0
+		for _, m := range broker.Messages() {
+			if m.Topic == "homeassistant/sensor/otecstar_office/down_snr/config" {
+				announced++
+			}
+		}
+		return announced == 2
+	})
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	_, broker := startMQTT(t, "Office 2")
+	for _, sensor := range haSensors {
+		topic := "homeassistant/" + sensor.component + "/otecstar_Office_2/" + sensor.key + "/config"
+		var m fakebroker.Message
+		waitFor(t, topic, func() bool {
+			var ok bool
+			m, ok = broker.Retained(topic)
+			return ok
+		})
+
+		var config struct {
+			Name              string `json:"name"`
+			UniqueID          string `json:"unique_id"`
+			StateTopic        string `json:"state_topic"`
+			ValueTemplate     string `json:"value_template"`
+			AvailabilityTopic string `json:"availability_topic"`
+			Unit              string `json:"unit_of_measurement"`
+			DeviceClass       string `json:"device_class"`
+			Device            struct {
+				Identifiers []string `json:"identifiers"`
+				Name        string   `json:"name"`
+			} `json:"device"`
+		}
+		if err := json.Unmarshal(m.Payload, &config); err != nil {
+			t.Fatalf("%s is not JSON: %v: %s", topic, err, m.Payload)
+		}
+		if config.Name != "OTECStar Office 2 "+sensor.name {
+			t.Errorf("%s name = %s", topic, config.Name)
+		}
+		if config.UniqueID != "otecstar_Office_2_"+sensor.key {
+			t.Errorf("%s unique_id = %s", topic, config.UniqueID)
+		}
+		if config.StateTopic != "otecstar/Office_2/state" || config.AvailabilityTopic != "otecstar/Office_2/availability" {
+			t.Errorf("%s topics = %s and %s", topic, config.StateTopic, config.AvailabilityTopic)
+		}
+		if config.ValueTemplate != sensor.template || config.Unit != sensor.unit || config.DeviceClass != sensor.deviceClass {
+			t.Errorf("%s = %s, want the template, unit and device class of %+v", topic, m.Payload, sensor)
+		}
+		if len(config.Device.Identifiers) != 1 || config.Device.Identifiers[0] != "otecstar_Office_2" || config.Device.Name != "OTECStar Office 2" {
+			t.Errorf("%s device = %+v", topic, config.Device)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Notifier shows desktop notifications
+type Notifier interface {
+	Notify(title, body string) error
+}
+
+// NewNotifier constructs the Notifier for given backend, "auto" picks the native one of current platform
+func NewNotifier(backend string) (Notifier, error) {
+	switch backend {
+	case "", "auto":
+		return newNativeNotifier()
+	case "log":
+		return logNotifier{}, nil
+	default:
+		if n := notifierBackends[backend]; n != nil {
+			return n()
+		}
+		return nil, fmt.Errorf("unknown notification backend %q", backend)
+	}
+}
+
+// notifierBackends are the optional backends available on current platform, by name
+var notifierBackends = map[string]func() (Notifier, error){}
+
+// logNotifier only logs notifications, for platforms without a native backend
+type logNotifier struct{}
+
+func (logNotifier) Notify(title, body string) error {
+	logger.Info().Str("title", title).Msg(body)
+	return nil
+}
+
+// Notifications notifies about changes of Health of every router. A new health is only notified after it
+// stayed for the debounce duration, so a flapping link does not bring a pile of notifications.
+type Notifications struct {
+	notifier   Notifier
+	showRouter bool // Whether titles name the router, there is no need with a single one
+
+	mu       sync.Mutex
+	detector *RouterTransitions
+}
+
+// NewNotifications constructs Notifications sending through notifier
+func NewNotifications(notifier Notifier, debounce time.Duration, showRouter bool) *Notifications {
+	return &Notifications{
+		notifier:   notifier,
+		showRouter: showRouter,
+		detector:   NewRouterTransitions(debounce),
+	}
+}
+
+// adopt takes the pending transitions of previous over, keeping the debounce duration of n
+func (n *Notifications) adopt(previous *Notifications) {
+	previous.mu.Lock()
+	detector := previous.detector
+	previous.mu.Unlock()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	detector.SetDebounce(n.detector.debounce)
+	n.detector = detector
+}
+
+// Consume checks a captured state for health changes, it's meant to be a Poller consumer
+func (n *Notifications) Consume(state *State) {
+	n.mu.Lock()
+	t := n.detector.Next(state)
+	n.mu.Unlock()
+	if t == nil {
+		return
+	}
+
+	title, body := "OTECStar: "+t.To.Description(), ""
+	if n.showRouter {
+		title = fmt.Sprintf("OTECStar %s: %s", state.Router, t.To.Description())
+	}
+	switch {
+	case t.To == HealthError:
+		body = fmt.Sprintf("Down since %s, failed: %s", t.At.Local().Format("15:04:05"), t.Cause)
+	case t.From == HealthError:
+		body = fmt.Sprintf("Back after %s of downtime", t.Downtime.Round(time.Second))
+	case t.To == HealthWarn:
+		body = fmt.Sprintf("Down SNR %s dB, up SNR %s dB, attenuation %s dB",
+			formatNumber(state.DownSNR), formatNumber(state.UpSNR), formatNumber(state.LinkLoss))
+		if state.Reason != "" {
+			body = "Rules fired: " + state.Reason + ". " + body
+		}
+	default:
+		body = "Line is stable again"
+	}
+
+	// Notifying may be slow, it must not hold up polling
+	go func() {
+		if err := n.notifier.Notify(title, body); err != nil {
+			logger.Error().Err(err).Msg("Failed to notify")
+		}
+	}()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// osascriptNotifier shows notifications through AppleScript
+type osascriptNotifier struct{}
+
+func newNativeNotifier() (Notifier, error) {
+	return osascriptNotifier{}, nil
+}
+
+func init() {
+	notifierBackends["osascript"] = newNativeNotifier
+}
+
+func (osascriptNotifier) Notify(title, body string) error {
+	script := "display notification " + strconv.Quote(body) + " with title " + strconv.Quote(title)
+	return exec.Command("osascript", "-e", script).Run()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/godbus/dbus/v5"
+	"sync"
+)
+
+// dbusNotifier sends freedesktop notifications over the session bus
+type dbusNotifier struct {
+	conn *dbus.Conn
+
+	mu     sync.Mutex
+	lastID uint32
+}
+
+func newNativeNotifier() (Notifier, error) {
+	conn, err := dbus.SessionBus()
+	if err != nil {
+		return nil, err
+	}
+	return &dbusNotifier{conn: conn}, nil
+}
+
+func init() {
+	notifierBackends["dbus"] = newNativeNotifier
+}
+
+// Notify replaces the previous notification if it's still shown
+func (n *dbusNotifier) Notify(title, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	obj := n.conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
+		"OTECStar", n.lastID, "network-wired", title, body,
+		[]string{}, map[string]dbus.Variant{}, int32(-1))
+	if call.Err != nil {
+		return call.Err
+	}
+	return call.Store(&n.lastID)
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package main
+
+func newNativeNotifier() (Notifier, error) {
+	return logNotifier{}, nil
+}
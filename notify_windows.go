@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// toastNotifier shows Windows toast notifications through PowerShell
+type toastNotifier struct{}
+
+func newNativeNotifier() (Notifier, error) {
+	return toastNotifier{}, nil
+}
+
+func init() {
+	notifierBackends["toast"] = newNativeNotifier
+}
+
+const toastScript = `
+[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$template = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$texts = $template.GetElementsByTagName("text")
+$texts.Item(0).AppendChild($template.CreateTextNode('{title}')) > $null
+$texts.Item(1).AppendChild($template.CreateTextNode('{body}')) > $null
+$toast = [Windows.UI.Notifications.ToastNotification]::new($template)
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('OTECStar').Show($toast)
+`
+
+func (toastNotifier) Notify(title, body string) error {
+	// Single quoted PowerShell strings only need `'` doubled
+	quote := strings.NewReplacer("'", "''")
+	script := strings.NewReplacer("{title}", quote.Replace(title), "{body}", quote.Replace(body)).Replace(toastScript)
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	return cmd.Run()
+}
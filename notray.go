@@ -0,0 +1,12 @@
+//go:build notray
+// +build notray
+
+package main
+
+// runTray falls back to daemon mode, since this build has no system tray support
+func runTray() {
+	logger.Warn().Msg("Built without system tray support, running as daemon")
+	if err := runDaemon(nil); err != nil {
+		logger.Fatal().Err(err).Msg("Daemon failed")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"otecstar/router"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recentOutages is how many outages OutageTracker keeps in memory
+const recentOutages = 10
+
+// Outage is a period during which the network was judged HealthError
+type Outage struct {
+	// Router names the router which was down, it's empty in outages logged before routers were named
+	Router string     `json:"router,omitempty"`
+	Start  time.Time  `json:"start"`
+	End    *time.Time `json:"end,omitempty"` // nil while ongoing
+	// Cause tells what failed: "wan", "link", "wan+link", or "router" when the router itself could not be read
+	Cause string `json:"cause"`
+	// Error is the capture error when Cause is "router"
+	Error string `json:"error,omitempty"`
+	// Before is the last state captured before the outage, if any
+	Before *State `json:"before,omitempty"`
+	// Interrupted is set when we stopped running during the outage, so it's unknown when it ended.
+	// It's logged by OpenOutageTracker, for outages a previous run left without an end.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// Duration is how long the outage lasted, or has lasted until now when it's ongoing. It's 0 if Interrupted.
+func (o *Outage) Duration(now time.Time) time.Duration {
+	if o.End != nil {
+		return o.End.Sub(o.Start)
+	}
+	if o.Interrupted {
+		return 0
+	}
+	return now.Sub(o.Start)
+}
+
+// lastedUntil tells whether the outage was still going on at t, or started later. An interrupted outage
+// only counts from its start, since it's unknown how long it went on.
+func (o *Outage) lastedUntil(t time.Time) bool {
+	if !o.Start.Before(t) {
+		return true
+	}
+	if o.End != nil {
+		return !o.End.Before(t)
+	}
+	return !o.Interrupted
+}
+
+// outageCause describes what failed in a state, or which rules fired
+func outageCause(state *State) string {
+	if state.Err != nil {
+		return "router"
+	}
+	var failed []string
+	if state.WAN != router.Connected {
+		failed = append(failed, "wan")
+	}
+	if state.Link != router.Connected {
+		failed = append(failed, "link")
+	}
+	// The line is up, but rules at error level fired
+	if len(failed) == 0 && state.Reason != "" {
+		return state.Reason
+	}
+	return strings.Join(failed, "+")
+}
+
+// OutageTracker turns the sequences of states captured from routers into outages, and persists them in a
+// JSON lines file. Each outage is written when it starts and again when it ends, the later line wins.
+type OutageTracker struct {
+	path string
+
+	mu       sync.Mutex
+	recent   []*Outage          // Oldest first, of every router
+	current  map[string]*Outage // By router
+	lastGood map[string]*State  // By router
+}
+
+// OpenOutageTracker loads recent outages from path, an empty path keeps outages in memory only
+func OpenOutageTracker(path string) (*OutageTracker, error) {
+	t := OutageTracker{
+		path:     path,
+		current:  map[string]*Outage{},
+		lastGood: map[string]*State{},
+	}
+	if path == "" {
+		return &t, nil
+	}
+	outages, err := readOutages(path)
+	if err != nil {
+		return nil, err
+	}
+	// An outage left ongoing by a previous run can not be ended by us, we don't know when it ended.
+	// It's marked so, or it would be taken for an ongoing one.
+	for _, o := range outages {
+		if o.End == nil && !o.Interrupted {
+			o.Interrupted = true
+			t.save(o)
+		}
+	}
+	if len(outages) > recentOutages {
+		outages = outages[len(outages)-recentOutages:]
+	}
+	t.recent = outages
+	return &t, nil
+}
+
+// adopt takes the ongoing outages of previous over, which logged them elsewhere. They are logged here too,
+// so they end here.
+func (t *OutageTracker) adopt(previous *OutageTracker) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, o := range previous.current {
+		if t.current[name] != nil {
+			continue
+		}
+		t.current[name] = o
+		// The log may have it from before, marked interrupted when t was opened
+		recent := t.recent[:0]
+		for _, r := range t.recent {
+			if r.Router != o.Router || !r.Start.Equal(o.Start) {
+				recent = append(recent, r)
+			}
+		}
+		t.recent = append(recent, o)
+		if len(t.recent) > recentOutages {
+			t.recent = t.recent[1:]
+		}
+		t.save(o)
+	}
+	for name, state := range previous.lastGood {
+		if t.lastGood[name] == nil {
+			t.lastGood[name] = state
+		}
+	}
+}
+
+// Consume tracks a captured state, it's meant to be a Poller consumer
+func (t *OutageTracker) Consume(state *State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	down := Evaluate(state) == HealthError
+	current := t.current[state.Router]
+	switch {
+	case down && current == nil:
+		current = &Outage{
+			Router: state.Router,
+			Start:  state.CapturedAt,
+			Cause:  outageCause(state),
+			Before: t.lastGood[state.Router],
+		}
+		if state.Err != nil {
+			current.Error = state.Err.Error()
+		}
+		t.current[state.Router] = current
+		t.recent = append(t.recent, current)
+		if len(t.recent) > recentOutages {
+			t.recent = t.recent[1:]
+		}
+		logger.Warn().Str("router", state.Router).Str("cause", current.Cause).Time("start", current.Start).Msg("Outage started")
+		t.save(current)
+	case !down && current != nil:
+		end := state.CapturedAt
+		current.End = &end
+		logger.Info().Str("router", state.Router).Str("cause", current.Cause).Dur("duration", current.Duration(end)).Msg("Outage ended")
+		t.save(current)
+		delete(t.current, state.Router)
+	}
+	if !down {
+		t.lastGood[state.Router] = state
+	}
+}
+
+// Current returns a copy of the ongoing outage of the router of given name, or nil
+func (t *OutageTracker) Current(name string) *Outage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current := t.current[name]
+	if current == nil {
+		return nil
+	}
+	o := *current
+	return &o
+}
+
+// Recent returns copies of the last n outages, newest first
+func (t *OutageTracker) Recent(n int) []Outage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var outages []Outage
+	for i := len(t.recent) - 1; i >= 0 && len(outages) < n; i-- {
+		outages = append(outages, *t.recent[i])
+	}
+	return outages
+}
+
+// Since returns the persisted outages which went on at or after since, oldest first. Without a log, they
+// are the recent ones kept in memory.
+func (t *OutageTracker) Since(since time.Time) ([]*Outage, error) {
+	if t.path != "" {
+		return readOutagesSince(t.path, since)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var outages []*Outage
+	for _, o := range t.recent {
+		if o.lastedUntil(since) {
+			copied := *o
+			outages = append(outages, &copied)
+		}
+	}
+	return outages, nil
+}
+
+func (t *OutageTracker) save(o *Outage) {
+	if t.path == "" {
+		return
+	}
+	data, err := json.Marshal(o)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to encode outage")
+		return
+	}
+	f, err := os.OpenFile(t.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to open outage log")
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		logger.Error().Err(err).Msg("Failed to write outage log")
+	}
+}
+
+// readOutagesSince reads the outages logged at path which went on at or after since, oldest first.
+// It only reads, so it's fine while another process tracks outages to path.
+func readOutagesSince(path string, since time.Time) ([]*Outage, error) {
+	all, err := readOutages(path)
+	if err != nil {
+		return nil, err
+	}
+	var outages []*Outage
+	for _, o := range all {
+		if o.lastedUntil(since) {
+			outages = append(outages, o)
+		}
+	}
+	return outages, nil
+}
+
+// readOutages reads the outage log at path, oldest first. Outages without an end are ongoing, unless they
+// were marked Interrupted.
+func readOutages(path string) ([]*Outage, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var outages []*Outage
+	// Outages of routers polled at once may start at the same time
+	type outageKey struct {
+		router string
+		start  time.Time
+	}
+	byStart := map[outageKey]*Outage{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var o Outage
+		if err := json.Unmarshal(scanner.Bytes(), &o); err != nil {
+			logger.Debug().Err(err).Msg("Skipped bad outage line")
+			continue
+		}
+		key := outageKey{o.Router, o.Start.UTC()}
+		if existing, ok := byStart[key]; ok {
+			*existing = o
+			continue
+		}
+		byStart[key] = &o
+		outages = append(outages, &o)
+	}
+	sort.Slice(outages, func(i, j int) bool {
+		return outages[i].Start.Before(outages[j].Start)
+	})
+	return outages, scanner.Err()
+}
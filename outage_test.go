@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"otecstar/router"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestTracker opens an OutageTracker logging to a new temporary directory, and returns the log path
+func openTestTracker(t *testing.T) (*OutageTracker, string) {
+	dir, err := ioutil.TempDir("", "otecstar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	path := filepath.Join(dir, "outages.jsonl")
+	tracker, err := OpenOutageTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tracker, path
+}
+
+func TestOutageStartsAndEnds(t *testing.T) {
+	tracker, path := openTestTracker(t)
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	good := testState(HealthOK, start.Add(-time.Second))
+	tracker.Consume(good)
+	tracker.Consume(testState(HealthError, start))
+	tracker.Consume(testState(HealthError, start.Add(time.Second)))
+
+	current := tracker.Current("192.168.123.1")
+	if current == nil || !current.Start.Equal(start) || current.End != nil || current.Cause != "wan" {
+		t.Fatalf("ongoing outage = %+v, want one started at %s of the WAN", current, start)
+	}
+	if current.Before == nil || !current.Before.CapturedAt.Equal(good.CapturedAt) {
+		t.Errorf("ongoing outage before = %+v, want the last good state", current.Before)
+	}
+
+	end := start.Add(time.Minute)
+	tracker.Consume(testState(HealthOK, end))
+	if current := tracker.Current("192.168.123.1"); current != nil {
+		t.Errorf("ongoing outage = %+v after the line came back", current)
+	}
+	recent := tracker.Recent(5)
+	if len(recent) != 1 || recent[0].End == nil || !recent[0].End.Equal(end) || recent[0].Duration(time.Now()) != time.Minute {
+		t.Errorf("recent outages = %+v, want one lasting a minute", recent)
+	}
+
+	// Logged when it started and again when it ended, read back as one
+	outages, err := readOutages(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outages) != 1 || outages[0].End == nil || !outages[0].End.Equal(end) || outages[0].Interrupted {
+		t.Errorf("logged outages = %+v, want the one which ended", outages)
+	}
+}
+
+func TestOutageOngoingUntilReopened(t *testing.T) {
+	tracker, path := openTestTracker(t)
+	start := time.Now().Add(-time.Hour)
+	tracker.Consume(testState(HealthError, start))
+
+	// Read by another process while it's tracked
+	outages, err := readOutagesSince(path, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outages) != 1 || outages[0].End != nil || outages[0].Interrupted {
+		t.Fatalf("outages = %+v, want an ongoing one", outages)
+	}
+	if d := outages[0].Duration(start.Add(time.Minute)); d != time.Minute {
+		t.Errorf("ongoing outage duration = %s, want until now", d)
+	}
+
+	// A new run can't tell when it ended
+	reopened, err := OpenOutageTracker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current := reopened.Current("192.168.123.1"); current != nil {
+		t.Errorf("ongoing outage = %+v after reopening", current)
+	}
+	recent := reopened.Recent(5)
+	if len(recent) != 1 || !recent[0].Interrupted || recent[0].Duration(time.Now()) != 0 {
+		t.Errorf("recent outages = %+v, want an interrupted one", recent)
+	}
+	// The mark is logged, so it's told apart from an ongoing outage without opening a tracker
+	outages, err = readOutagesSince(path, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outages) != 1 || outages[0].End != nil || !outages[0].Interrupted {
+		t.Errorf("outages = %+v, want an interrupted one", outages)
+	}
+	// It only counts from its start
+	if outages, _ := readOutagesSince(path, start.Add(time.Second)); len(outages) != 0 {
+		t.Errorf("outages since after the start of an interrupted one = %+v, want none", outages)
+	}
+
+	// It's not logged twice
+	if _, err := OpenOutageTracker(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("outage log has %d lines, want the start and the mark: %s", lines, data)
+	}
+}
+
+func TestOutagesSince(t *testing.T) {
+	tracker, _ := openTestTracker(t)
+	start := time.Now().Add(-time.Hour * 3)
+	// Ended two hours ago, then down again an hour ago and still ongoing
+	tracker.Consume(testState(HealthError, start))
+	tracker.Consume(testState(HealthOK, start.Add(time.Hour)))
+	tracker.Consume(testState(HealthError, start.Add(time.Hour*2)))
+
+	tests := []struct {
+		since time.Duration
+		want  int
+	}{
+		{time.Hour * 4, 2},
+		{time.Hour*2 - time.Minute, 1},
+		{time.Minute, 1},
+	}
+	for _, test := range tests {
+		outages, err := tracker.Since(time.Now().Add(-test.since))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(outages) != test.want {
+			t.Errorf("outages since %s ago = %+v, want %d", test.since, outages, test.want)
+		}
+	}
+}
+
+func TestOutageCause(t *testing.T) {
+	tests := []struct {
+		name  string
+		state State
+		want  string
+	}{
+		{"router", State{State: router.State{Err: errors.New("timeout")}}, "router"},
+		{"wan", State{State: router.State{WANStatus: router.WANStatus{WAN: router.Disconnected, Link: router.Connected}}}, "wan"},
+		{"both", State{State: router.State{WANStatus: router.WANStatus{WAN: router.Disconnected, Link: router.Disconnected}}}, "wan+link"},
+		{"rules", State{State: router.State{WANStatus: router.WANStatus{WAN: router.Connected, Link: router.Connected}}, Reason: "down_snr < 6"}, "down_snr < 6"},
+	}
+	for _, test := range tests {
+		if got := outageCause(&test.state); got != test.want {
+			t.Errorf("outageCause(%s) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
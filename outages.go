@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runOutages prints logged outages
+func runOutages(args []string) error {
+	flags := flag.NewFlagSet("outages", flag.ExitOnError)
+	addConfigFlags(flags)
+	since := flags.String("since", "7d", "how far to look back, a Go duration or a number of days like 7d")
+	asJSON := flags.Bool("json", false, "print as JSON lines")
+	name := flags.String("router", "", "only print outages of the router of this name")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	lookBack, err := parseLookBack(*since)
+	if err != nil {
+		return err
+	}
+
+	config, err := prepare()
+	if err != nil {
+		return err
+	}
+	if !config.History.Enabled {
+		return fmt.Errorf("outages are not logged since history is disabled")
+	}
+	// Read only, a running otecstar may be tracking outages to the log
+	outages, err := readOutagesSince(config.History.OutagesPath, time.Now().Add(-lookBack))
+	if err != nil {
+		return err
+	}
+	if *name != "" {
+		if _, err := config.router(*name); err != nil {
+			return err
+		}
+		var filtered []*Outage
+		for _, o := range outages {
+			if o.Router == *name {
+				filtered = append(filtered, o)
+			}
+		}
+		outages = filtered
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, o := range outages {
+			if err := encoder.Encode(o); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	now := time.Now()
+	// Only worth a column when there are several routers
+	showRouter := len(config.Routers) > 1
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if showRouter {
+		fmt.Fprint(w, "ROUTER\t")
+	}
+	fmt.Fprintln(w, "START\tEND\tDURATION\tCAUSE\tDOWN SNR BEFORE\tATTENUATION BEFORE")
+	for _, o := range outages {
+		if showRouter {
+			name := o.Router
+			if name == "" {
+				name = "-"
+			}
+			fmt.Fprintf(w, "%s\t", name)
+		}
+		end, duration := "ongoing", o.Duration(now).Round(time.Second).String()
+		if o.End != nil {
+			end = o.End.Local().Format("2006-01-02 15:04:05")
+		} else if o.Interrupted {
+			end, duration = "?", "?"
+		}
+		snr, loss := "-", "-"
+		if o.Before != nil {
+			snr = formatNumber(o.Before.DownSNR) + " dB"
+			loss = formatNumber(o.Before.LinkLoss) + " dB"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			o.Start.Local().Format("2006-01-02 15:04:05"), end, duration, o.Cause, snr, loss)
+	}
+	return w.Flush()
+}
+
+// parseLookBack parses a Go duration, also accepting a number of days like `7d`
+func parseLookBack(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days * float64(time.Hour*24)), nil
+	}
+	return time.ParseDuration(s)
+}
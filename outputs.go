@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"otecstar/dashboard"
+	"otecstar/router"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Outputs are everything fed by the Poller other than the UI, shared by tray and daemon modes
+type Outputs struct {
+	config   *Config
+	metrics  *Metrics
+	api      *API
+	stream   *Stream
+	history  *History
+	outages  *OutageTracker
+	notify   *Notifications
+	webhooks []*Webhook
+	mqtt     *MQTTPublisher
+	server   *http.Server
+	// routes serve the requests of server, they are switched to the ones of the next Outputs on Adopt
+	routes *routeSwitch
+	// mux is what routes should serve for these outputs, and listen the configured address
+	mux    http.Handler
+	listen string
+	// listenAddr is the address the HTTP listener is bound to, empty without a listener
+	listenAddr string
+	// consumers are the Consume methods of the outputs, in order
+	consumers []func(state *State)
+}
+
+// StartOutputs starts the outputs enabled in config, and the HTTP listener if there is one.
+// They are fed by Consume, which is meant to be a consumer of pollers, one per router of config in order.
+// When reloading, last are the outputs running so far, nil otherwise. Those whose config did not change are
+// shared with last, the others are started anew and Adopt takes what they were tracking over. When last
+// listens on the same address, its listener is left to Adopt too, since it can't be bound twice. History is
+// shared as long as its path is the same, Adopt applies its new config.
+func StartOutputs(config *Config, pollers []*Poller, last *Outputs) (*Outputs, error) {
+	var (
+		names     []string
+		clients   []*router.Client
+		intervals []func() time.Duration
+		routerIPs = map[string]string{}
+	)
+	// Pollers may not have applied a reloaded config yet, names are taken from it
+	for i, routerConfig := range config.Routers {
+		names = append(names, routerConfig.Name)
+		clients = append(clients, pollers[i].client)
+		intervals = append(intervals, pollers[i].Interval)
+		routerIPs[routerConfig.Name] = routerConfig.RouterIP
+	}
+	if last == nil {
+		last = &Outputs{config: &Config{}}
+	}
+	sameRouters := reflect.DeepEqual(routerAddresses(last.config), routerAddresses(config))
+
+	o := Outputs{config: config}
+	if o.metrics = last.metrics; !sameRouters || o.metrics == nil {
+		o.metrics = NewMetrics(names, clients)
+	}
+	o.onState(o.metrics.Consume)
+
+	// Outages are always tracked, but only logged to disk along with history
+	outagesPath := ""
+	if config.History.Enabled {
+		// Replacing the History of a path would lose states, see History
+		if o.history = last.history; o.history == nil || last.config.History.Path != config.History.Path {
+			history, err := OpenHistory(&config.History)
+			if err != nil {
+				return nil, err
+			}
+			o.history = history
+		}
+		o.onState(o.history.Consume)
+		outagesPath = config.History.OutagesPath
+	}
+	if o.outages = last.outages; o.outages == nil || o.outages.path != outagesPath {
+		outages, err := OpenOutageTracker(outagesPath)
+		if err != nil {
+			o.abort(last)
+			return nil, err
+		}
+		o.outages = outages
+	}
+	o.onState(o.outages.Consume)
+
+	if config.Notify.Enabled {
+		showRouter := len(names) > 1
+		if o.notify = last.notify; last.config.Notify != config.Notify || o.notify == nil || o.notify.showRouter != showRouter {
+			notifier, err := NewNotifier(config.Notify.Backend)
+			if err != nil {
+				logger.Warn().Err(err).Str("backend", config.Notify.Backend).Msg("Notifications fall back to logs")
+				notifier = logNotifier{}
+			}
+			o.notify = NewNotifications(notifier, config.Notify.Debounce, showRouter)
+		}
+		o.onState(o.notify.Consume)
+	}
+
+	for _, webhookConfig := range config.Webhooks {
+		webhook := last.webhook(webhookConfig.Name)
+		if !sameRouters || webhook == nil || !reflect.DeepEqual(webhook.config, webhookConfig) {
+			var err error
+			if webhook, err = NewWebhook(webhookConfig, routerIPs); err != nil {
+				o.abort(last)
+				return nil, err
+			}
+		}
+		o.webhooks = append(o.webhooks, webhook)
+		o.onState(webhook.Consume)
+	}
+
+	if config.MQTT.Broker != "" {
+		if o.mqtt = last.mqtt; !sameRouters || last.config.MQTT != config.MQTT || o.mqtt == nil {
+			o.mqtt = NewMQTTPublisher(&config.MQTT, config.Routers)
+		}
+		o.onState(o.mqtt.Consume)
+	}
+
+	o.api = NewAPI(o.history, o.outages, o.metrics, names, intervals)
+	o.onState(o.api.Consume)
+	if o.stream = last.stream; !sameRouters || o.stream == nil {
+		o.stream = NewStream()
+	}
+	o.onState(o.stream.Consume)
+
+	if config.HTTP.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", o.metrics)
+		o.api.Register(mux)
+		o.stream.Register(mux)
+		mux.Handle("/", dashboard.Handler())
+		o.mux, o.listen = mux, config.HTTP.Listen
+		if last.server != nil && last.listen == o.listen {
+			return &o, nil
+		}
+
+		listener, err := net.Listen("tcp", config.HTTP.Listen)
+		if err != nil {
+			o.abort(last)
+			return nil, err
+		}
+		o.listenAddr = listener.Addr().String()
+		o.routes = &routeSwitch{handler: mux}
+		o.server = &http.Server{Handler: o.routes}
+		go func() {
+			if err := o.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				logger.Error().Err(err).Msg("HTTP listener failed")
+			}
+		}()
+		logger.Info().Str("listen", listener.Addr().String()).Msg("HTTP listener ready")
+	}
+	return &o, nil
+}
+
+// Adopt takes over from last, which StartOutputs was given. The outputs started anew take what the ones of
+// last were tracking: ongoing outages, pending transitions, undelivered webhook events and latest states.
+// The HTTP listener is taken over too if StartOutputs left it to, so it keeps serving across a reload.
+// Closing last then only closes what is not shared. Consumers should not feed last meanwhile.
+func (o *Outputs) Adopt(last *Outputs) {
+	if o.history != nil && o.history == last.history && o.config.History != last.config.History {
+		o.history.Reconfigure(&o.config.History)
+	}
+	if o.outages != last.outages {
+		o.outages.adopt(last.outages)
+	}
+	if o.notify != nil && last.notify != nil && o.notify != last.notify {
+		o.notify.adopt(last.notify)
+	}
+	for _, webhook := range o.webhooks {
+		if previous := last.webhook(webhook.config.Name); previous != nil && previous != webhook {
+			webhook.adopt(previous)
+		}
+	}
+	o.api.adopt(last.api)
+	last.detach(o)
+
+	if o.mux == nil || o.server != nil || last.server == nil || last.listen != o.listen {
+		return
+	}
+	o.server, o.routes, o.listenAddr = last.server, last.routes, last.listenAddr
+	last.server = nil
+	o.routes.set(o.mux)
+}
+
+// abort closes what StartOutputs started before failing, leaving what's shared with last running
+func (o *Outputs) abort(last *Outputs) {
+	o.detach(last)
+	o.Close()
+}
+
+// detach forgets the outputs shared with other, so that closing o leaves them running
+func (o *Outputs) detach(other *Outputs) {
+	if o.stream == other.stream {
+		o.stream = nil
+	}
+	if o.history == other.history {
+		o.history = nil
+	}
+	if o.mqtt == other.mqtt {
+		o.mqtt = nil
+	}
+	var webhooks []*Webhook
+	for _, webhook := range o.webhooks {
+		if other.webhook(webhook.config.Name) != webhook {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	o.webhooks = webhooks
+}
+
+// webhook is the webhook of given name, or nil
+func (o *Outputs) webhook(name string) *Webhook {
+	for _, webhook := range o.webhooks {
+		if webhook.config.Name == name {
+			return webhook
+		}
+	}
+	return nil
+}
+
+// routeSwitch is an http.Handler serving with the handler set last
+type routeSwitch struct {
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+func (s *routeSwitch) set(handler http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = handler
+}
+
+func (s *routeSwitch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.RLock()
+	handler := s.handler
+	s.mu.RUnlock()
+	handler.ServeHTTP(w, req)
+}
+
+func (o *Outputs) onState(consumer func(state *State)) {
+	o.consumers = append(o.consumers, consumer)
+}
+
+// Consume hands a captured state to every output, it's safe to call from the goroutines of several Pollers
+func (o *Outputs) Consume(state *State) {
+	for _, consumer := range o.consumers {
+		consumer(state)
+	}
+}
+
+// Notify shows a desktop notification, if notifications are enabled
+func (o *Outputs) Notify(title, body string) {
+	if o.notify == nil {
+		return
+	}
+	if err := o.notify.notifier.Notify(title, body); err != nil {
+		logger.Warn().Err(err).Msg("Failed to notify")
+	}
+}
+
+// DashboardURL is where the web dashboard is served, empty without an HTTP listener
+func (o *Outputs) DashboardURL() string {
+	if o.listenAddr == "" {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(o.listenAddr)
+	if err != nil {
+		return ""
+	}
+	// Wildcard listeners are reachable through loopback
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/"
+}
+
+// Close shuts the outputs down
+func (o *Outputs) Close() {
+	if o.stream != nil {
+		o.stream.Close()
+	}
+	if o.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		_ = o.server.Shutdown(ctx)
+	}
+	for _, webhook := range o.webhooks {
+		webhook.Close()
+	}
+	if o.mqtt != nil {
+		o.mqtt.Close()
+	}
+	if o.history != nil {
+		if err := o.history.Close(); err != nil {
+			logger.Error().Err(err).Msg("Failed to close history")
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"otecstar/router"
+	"sync"
+	"time"
+)
+
+// Poller captures states from a router at an interval, and hands every state to its consumers.
+// It is the only thing that talks to its router, all outputs (tray, daemon, ...) consume from it.
+// Every router has its own Poller, running concurrently with the others.
+// There is at most one poll in flight. Stop, CancelPoll and Reconfigure cancel it, and so does a tick once
+// the poll is overdue: it took longer than the interval and what timeouts and retries allow. Earlier ticks
+// while polling are skipped, so retries and slow routers still get through.
+type Poller struct {
+	client    *router.Client
+	rules     *Rules
+	retry     *RetryConfig
+	breaker   *Breaker
+	ctx       context.Context // Canceled by Stop
+	stop      context.CancelFunc
+	refreshCh chan struct{}
+	resetCh   chan struct{}
+	configCh  chan *pollerConfig
+	consumers []func(state *State)
+
+	mu         sync.Mutex
+	name       string // Of the router, states are labeled with it
+	interval   time.Duration
+	timeout    time.Duration // See pollTimeout
+	paused     bool
+	cancelPoll context.CancelFunc // Of the poll in flight, nil between polls
+	overdue    bool               // Whether the poll in flight was canceled by a tick
+}
+
+// errPollOverdue is the failure of a poll canceled by a tick, since it went on for too long
+var errPollOverdue = errors.New("poll overdue")
+
+// pollTimeout is how long a poll can take while the router answers within the timeouts of config: a login
+// and a fetch for every attempt, twice when the session expired, and the delays between attempts
+func pollTimeout(config *Config) time.Duration {
+	request := config.ConnectTimeout + config.ReadTimeout
+	timeout := time.Duration(config.Retry.Attempts) * 4 * request
+	delay := config.Retry.Backoff
+	for attempt := 1; attempt < config.Retry.Attempts; attempt++ {
+		timeout += delay + delay/5 // With the most jitter
+		delay = doubled(delay, config.Retry.MaxBackoff)
+	}
+	return timeout
+}
+
+// pollerConfig is what Reconfigure hands to the polling goroutine
+type pollerConfig struct {
+	config *Config
+	router *RouterConfig
+}
+
+// NewPoller constructs a Poller of a router of config, consumers should be added before it runs
+func NewPoller(config *Config, routerConfig *RouterConfig) *Poller {
+	if routerConfig.Interval < time.Second {
+		logger.Warn().Dur("interval", routerConfig.Interval).
+			Dur("actualInterval", time.Second).
+			Msg("Interval should be at least 1 second")
+		routerConfig.Interval = time.Second
+	}
+	client := router.NewClient(routerConfig.RouterIP, routerConfig.Username, routerConfig.Password)
+	client.SetTimeouts(config.ConnectTimeout, config.ReadTimeout)
+	ctx, stop := context.WithCancel(context.Background())
+	return &Poller{
+		client:    client,
+		rules:     NewRules(routerConfig.Rules),
+		retry:     &config.Retry,
+		breaker:   NewBreaker(&config.Retry),
+		ctx:       ctx,
+		stop:      stop,
+		name:      routerConfig.Name,
+		interval:  routerConfig.Interval,
+		timeout:   pollTimeout(config),
+		refreshCh: make(chan struct{}, 1),
+		resetCh:   make(chan struct{}, 1),
+		configCh:  make(chan *pollerConfig, 1),
+	}
+}
+
+// NewPollers constructs a Poller for every router of config, in order
+func NewPollers(config *Config) []*Poller {
+	var pollers []*Poller
+	for _, routerConfig := range config.Routers {
+		pollers = append(pollers, NewPoller(config, routerConfig))
+	}
+	return pollers
+}
+
+// OnState adds a consumer, consumers are called in order from the polling goroutine.
+// States of canceled polls are dropped.
+func (p *Poller) OnState(consumer func(state *State)) {
+	p.consumers = append(p.consumers, consumer)
+}
+
+// Run polls until Stop is called
+func (p *Poller) Run() {
+	ticker := time.NewTicker(p.Interval())
+	defer func() {
+		ticker.Stop()
+	}()
+	defer p.client.Close()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.resetCh:
+			ticker.Stop()
+			ticker = time.NewTicker(p.Interval())
+			continue
+		case c := <-p.configCh:
+			p.apply(c.config, c.router)
+			ticker.Stop()
+			ticker = time.NewTicker(p.Interval())
+		case <-ticker.C:
+			if p.Paused() || !p.breaker.Allow(time.Now()) {
+				continue
+			}
+		case <-p.refreshCh:
+		}
+		// A poll canceled as overdue makes way for the poll of the tick which canceled it
+		for p.poll(ticker.C) && !p.Paused() && p.breaker.Allow(time.Now()) {
+		}
+		// The ticker keeps a tick which came at the end of a poll, it's skipped rather than polled right away
+		select {
+		case <-ticker.C:
+		default:
+		}
+	}
+}
+
+// poll captures a state and hands it to consumers, unless the poll got canceled. Meanwhile it takes ticks,
+// and cancels itself at a tick past its deadline. It tells whether it did.
+func (p *Poller) poll(ticks <-chan time.Time) (overdue bool) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	start := time.Now()
+	p.mu.Lock()
+	p.cancelPoll, p.overdue = cancel, false
+	deadline := start.Add(p.interval)
+	if p.timeout > p.interval {
+		deadline = start.Add(p.timeout)
+	}
+	p.mu.Unlock()
+
+	watched := make(chan struct{})
+	stopWatching := make(chan struct{})
+	go func() {
+		defer close(watched)
+		for {
+			select {
+			case <-stopWatching:
+				return
+			case at := <-ticks:
+				if !at.After(deadline) {
+					continue
+				}
+				p.mu.Lock()
+				// Unless it was canceled otherwise already
+				if ctx.Err() == nil {
+					p.overdue = true
+					cancel()
+				}
+				p.mu.Unlock()
+				return
+			}
+		}
+	}()
+
+	state := p.getState(ctx, start)
+	close(stopWatching)
+	<-watched
+	p.mu.Lock()
+	p.cancelPoll = nil
+	overdue = p.overdue && p.ctx.Err() == nil
+	p.mu.Unlock()
+	cancel()
+
+	if state == nil {
+		logger.Debug().Str("router", p.Name()).Msg("Poll canceled")
+		return overdue
+	}
+	for _, consumer := range p.consumers {
+		consumer(state)
+	}
+	return overdue
+}
+
+// Reconfigure applies the name, router, credentials, interval and rules of routerConfig, along with the
+// timeouts and retries of config. The poll in flight is canceled, and a new one starts right away with a
+// fresh login.
+func (p *Poller) Reconfigure(config *Config, routerConfig *RouterConfig) {
+	p.CancelPoll()
+	// Only the latest config matters
+	select {
+	case <-p.configCh:
+	default:
+	}
+	p.configCh <- &pollerConfig{config: config, router: routerConfig}
+}
+
+// apply is Reconfigure from the polling goroutine, between polls
+func (p *Poller) apply(config *Config, routerConfig *RouterConfig) {
+	p.client.SetCredentials(routerConfig.RouterIP, routerConfig.Username, routerConfig.Password)
+	p.client.SetTimeouts(config.ConnectTimeout, config.ReadTimeout)
+	p.rules = NewRules(routerConfig.Rules)
+	p.retry = &config.Retry
+	p.breaker = NewBreaker(&config.Retry)
+	p.mu.Lock()
+	p.name = routerConfig.Name
+	p.interval = routerConfig.Interval
+	p.timeout = pollTimeout(config)
+	p.mu.Unlock()
+}
+
+// Name is the name of the router, which labels its states
+func (p *Poller) Name() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.name
+}
+
+// CancelPoll cancels the poll in flight if there is one, its state is dropped
+func (p *Poller) CancelPoll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancelPoll != nil {
+		p.cancelPoll()
+	}
+}
+
+// Refresh captures a state right away, even when paused by the user or the Breaker.
+// A poll in flight is canceled to start over.
+func (p *Poller) Refresh() {
+	p.CancelPoll()
+	select {
+	case p.refreshCh <- struct{}{}:
+	default:
+	}
+}
+
+// Interval is the current polling interval
+func (p *Poller) Interval() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.interval
+}
+
+// SetInterval changes the polling interval, the next state is captured one new interval later
+func (p *Poller) SetInterval(interval time.Duration) {
+	if interval < time.Second {
+		interval = time.Second
+	}
+	p.mu.Lock()
+	p.interval = interval
+	p.mu.Unlock()
+	select {
+	case p.resetCh <- struct{}{}:
+	default:
+	}
+}
+
+// Paused tells whether polling at the interval is paused
+func (p *Poller) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// SetPaused pauses or resumes polling at the interval
+func (p *Poller) SetPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = paused
+}
+
+// Stop cancels the poll in flight and makes Run return, it is safe to call more than once
+func (p *Poller) Stop() {
+	p.stop()
+}
+
+// getState captures a state from the router and judges its health. It returns nil if ctx got canceled,
+// unless the poll started at start was overdue: the state is a failure then.
+func (p *Poller) getState(ctx context.Context, start time.Time) *State {
+	name := p.Name()
+	logger.Debug().Str("router", name).Msg("getState")
+	state := p.capture(ctx)
+	if ctx.Err() != nil {
+		p.mu.Lock()
+		overdue := p.overdue && p.ctx.Err() == nil
+		p.mu.Unlock()
+		if !overdue {
+			return nil
+		}
+		state.CapturedAt, state.RoundTrip = start, time.Since(start)
+		state.Err = fmt.Errorf("%w, the router did not answer in %s", errPollOverdue, state.RoundTrip.Round(time.Second))
+	}
+	state.Router = name
+	p.breaker.Record(state)
+	if state.Err != nil {
+		logger.Error().Err(state.Err).Str("router", name).Str("failure", router.Classify(state.Err)).Msg("Failed to get WAN status")
+	}
+	p.rules.Judge(state)
+	return state
+}
+
+// capture captures a state, retrying failures with backoff. Auth failures are not retried,
+// since trying wrong credentials again could get the account locked.
+func (p *Poller) capture(ctx context.Context) *State {
+	delay := p.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		state := newState(p.client.Capture(ctx))
+		if state.Err == nil || ctx.Err() != nil || attempt >= p.retry.Attempts || router.Classify(state.Err) == router.FailureAuth {
+			return state
+		}
+		wait := withJitter(delay)
+		logger.Warn().Err(state.Err).Str("router", p.Name()).Int("attempt", attempt).Dur("retryIn", wait).Msg("Failed to get WAN status, retrying")
+		select {
+		case <-ctx.Done():
+			return state
+		case <-time.After(wait):
+		}
+		delay = doubled(delay, p.retry.MaxBackoff)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"otecstar/router"
+	"otecstar/router/fakerouter"
+	"testing"
+	"time"
+)
+
+// startPoller runs a Poller of a fake router, logging in with password. Its states come out of the channel.
+func startPoller(t *testing.T, password string) (*Poller, *fakerouter.Router, <-chan *State) {
+	fake := fakerouter.New("admin", "secret")
+	server := fakerouter.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	config := defaultConfig()
+	config.ConnectTimeout, config.ReadTimeout = time.Second, time.Second
+	config.Retry.Backoff = time.Millisecond * 10
+	routerConfig := &RouterConfig{
+		Name:       "test",
+		AuthConfig: &AuthConfig{RouterIP: server.Listener.Addr().String(), Username: "admin", Password: password},
+		Interval:   time.Hour,
+		section:    "auth",
+	}
+
+	p := NewPoller(&config, routerConfig)
+	states := make(chan *State, 10)
+	p.OnState(func(state *State) {
+		states <- state
+	})
+	done := make(chan struct{})
+	go func() {
+		p.Run()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		p.Stop()
+		<-done
+	})
+	return p, fake, states
+}
+
+// nextState waits for the next state of a Poller
+func nextState(t *testing.T, states <-chan *State) *State {
+	t.Helper()
+	select {
+	case state := <-states:
+		return state
+	case <-time.After(time.Second * 5):
+		t.Fatal("no state from the poller")
+		return nil
+	}
+}
+
+func TestPollerCapturesStates(t *testing.T) {
+	p, fake, states := startPoller(t, "secret")
+
+	p.Refresh()
+	state := nextState(t, states)
+	if state.Err != nil {
+		t.Fatalf("state.Err = %v", state.Err)
+	}
+	if state.Router != "test" || state.WAN != router.Connected || state.DownRate != 100 {
+		t.Errorf("state = %+v, want the connected router named test", state.WANStatus)
+	}
+	if state.Health != HealthOK {
+		t.Errorf("Health = %s, want %s", state.Health, HealthOK)
+	}
+
+	fake.SetDown(true)
+	p.Refresh()
+	if state = nextState(t, states); state.WAN != router.Disconnected || state.Health != HealthError {
+		t.Errorf("state = %+v with health %s, want a disconnected router in error", state.WANStatus, state.Health)
+	}
+	if logins := fake.Logins(); logins != 1 {
+		t.Errorf("router saw %d logins, want the session to be kept", logins)
+	}
+}
+
+func TestPollerRefreshesWhilePaused(t *testing.T) {
+	p, _, states := startPoller(t, "secret")
+	p.SetPaused(true)
+	p.SetInterval(time.Second)
+
+	p.Refresh()
+	if state := nextState(t, states); state.Err != nil {
+		t.Errorf("state.Err = %v", state.Err)
+	}
+	select {
+	case state := <-states:
+		t.Errorf("paused poller captured %+v at its interval", state.WANStatus)
+	case <-time.After(time.Millisecond * 1500):
+	}
+}
+
+func TestPollerRetries(t *testing.T) {
+	p, fake, states := startPoller(t, "secret")
+	p.retry.Backoff = time.Millisecond * 200
+	fake.SetUnreachable(true)
+
+	p.Refresh()
+	// The router comes back while the poller waits to retry
+	for p.client.Stats().NetworkFailures == 0 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	fake.SetUnreachable(false)
+	if state := nextState(t, states); state.Err != nil {
+		t.Errorf("state.Err = %v, want a retry to get through", state.Err)
+	}
+	if failures := p.client.Stats().NetworkFailures; failures != 1 {
+		t.Errorf("poller failed %d times, want 1", failures)
+	}
+}
+
+func TestPollerCapsRetryBackoff(t *testing.T) {
+	p, fake, states := startPoller(t, "secret")
+	p.retry.Attempts = 4
+	p.retry.Backoff = time.Millisecond * 100
+	p.retry.MaxBackoff = time.Millisecond * 150
+	fake.SetUnreachable(true)
+
+	// Waits 100ms, then 150ms twice instead of 200ms and 400ms
+	start := time.Now()
+	p.Refresh()
+	state := nextState(t, states)
+	if state.Err == nil {
+		t.Fatal("state.Err = nil, want the router unreachable")
+	}
+	if took := time.Since(start); took > time.Millisecond*600 {
+		t.Errorf("poll took %s, want retries at most 150ms apart", took)
+	}
+	if failures := p.client.Stats().NetworkFailures; failures != 4 {
+		t.Errorf("poller failed %d times, want 4", failures)
+	}
+}
+
+func TestPollerDoesNotRetryAuthFailures(t *testing.T) {
+	p, fake, states := startPoller(t, "wrong")
+
+	p.Refresh()
+	state := nextState(t, states)
+	if !errors.Is(state.Err, router.ErrLoginFailed) {
+		t.Fatalf("state.Err = %v, want ErrLoginFailed", state.Err)
+	}
+	if state.Health != HealthError {
+		t.Errorf("Health = %s, want %s", state.Health, HealthError)
+	}
+	if stats := p.client.Stats(); stats.LoginAttempts != 1 {
+		t.Errorf("poller tried to log in %d times, want 1", stats.LoginAttempts)
+	}
+	if logins := fake.Logins(); logins != 0 {
+		t.Errorf("router saw %d logins, want 0", logins)
+	}
+}
+
+func TestPollerDropsCanceledPolls(t *testing.T) {
+	p, fake, states := startPoller(t, "secret")
+	fake.SetDelay(time.Millisecond * 500)
+
+	p.Refresh()
+	time.Sleep(time.Millisecond * 100)
+	fake.SetDelay(0)
+	p.Refresh()
+	if state := nextState(t, states); state.Err != nil {
+		t.Errorf("state.Err = %v, want the state of the second poll", state.Err)
+	}
+	select {
+	case state := <-states:
+		t.Errorf("got a second state %+v, want the canceled poll dropped", state.WANStatus)
+	case <-time.After(time.Millisecond * 600):
+	}
+}
+
+func TestPollerCancelsOverduePolls(t *testing.T) {
+	p, fake, states := startPoller(t, "secret")
+	// The router takes longer than the timeouts, which are made to allow it
+	p.client.SetTimeouts(time.Second*10, time.Second*10)
+	p.mu.Lock()
+	p.timeout = 0
+	p.mu.Unlock()
+	fake.SetDelay(time.Second * 30)
+	p.SetInterval(time.Second)
+
+	// Polled at the first tick, the third one finds the poll past its deadline of an interval
+	state := nextState(t, states)
+	if !errors.Is(state.Err, errPollOverdue) {
+		t.Fatalf("state.Err = %v, want the poll overdue", state.Err)
+	}
+	if state.Health != HealthError || state.RoundTrip < time.Second {
+		t.Errorf("state = %+v with health %s, want an error which took over an interval", state.State, state.Health)
+	}
+	// The tick which canceled it polls again
+	waitFor(t, "the next poll", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.cancelPoll != nil
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redacted replaces secrets in logs
+const redacted = "[REDACTED]"
+
+// redactedKeys are parts of log field names whose values are never logged
+var redactedKeys = []string{"cookie", "password", "username", "secret", "token"}
+
+// redactedPatterns mask secrets inside any logged text, the first group is kept
+var redactedPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(stok=)[^/&;\s"]+`),
+	regexp.MustCompile(`(sysauth=)[^;\s"]+`),
+}
+
+var (
+	secretsMu sync.RWMutex
+	// secretValues are masked wherever they show up in logs, like passwords and usernames from config
+	secretValues []string
+)
+
+// redactValues makes values masked in logs from now on, besides those already masked. Empty ones are ignored.
+func redactValues(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secretValues = appendSecrets(secretValues, values)
+}
+
+// setRedactedValues makes values the only ones masked in logs from now on, like when config is reloaded
+func setRedactedValues(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secretValues = appendSecrets(nil, values)
+}
+
+// appendSecrets appends values to secrets, leaving out empty and known ones
+func appendSecrets(secrets, values []string) []string {
+	for _, v := range values {
+		known := v == ""
+		for _, secret := range secrets {
+			known = known || secret == v
+		}
+		if !known {
+			secrets = append(secrets, v)
+		}
+	}
+	return secrets
+}
+
+// redactWriter masks secrets in zerolog events before handing them to next
+type redactWriter struct {
+	next io.Writer
+}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	var event map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(p))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		_, err := w.next.Write([]byte(redactString(string(p))))
+		return len(p), err
+	}
+	for key, value := range event {
+		event[key] = redactField(key, value)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.next.Write(append(data, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactField masks the value of a field, wholly when its name tells it's a secret
+func redactField(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, k := range redactedKeys {
+		if strings.Contains(lower, k) {
+			return redacted
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		return redactString(v)
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = redactField(key, value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactField("", value)
+		}
+	}
+	return value
+}
+
+// redactString masks known secrets and secret looking parts of s
+func redactString(s string) string {
+	for _, pattern := range redactedPatterns {
+		s = pattern.ReplaceAllString(s, "${1}"+redacted)
+	}
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secretValues {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+	return s
+}
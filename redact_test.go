@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// useSecrets makes values the masked ones during the test
+func useSecrets(t *testing.T, values ...string) {
+	secretsMu.RLock()
+	kept := secretValues
+	secretsMu.RUnlock()
+	setRedactedValues(values...)
+	t.Cleanup(func() {
+		secretsMu.Lock()
+		defer secretsMu.Unlock()
+		secretValues = kept
+	})
+}
+
+func TestRedactWriter(t *testing.T) {
+	useSecrets(t, "hunter2", "operator")
+	tests := []struct {
+		name  string
+		event string
+		// hidden must not be written, shown must be
+		hidden []string
+		shown  []string
+	}{
+		{
+			name:   "field",
+			event:  `{"level":"debug","password":"letmein","cookie":"sysauth=abc","message":"Logging in"}`,
+			hidden: []string{"letmein", "abc"},
+			shown:  []string{`"password":"[REDACTED]"`, "Logging in"},
+		},
+		{
+			name:   "nested field",
+			event:  `{"level":"debug","auth":{"Password":"letmein","RouterIP":"192.168.123.1"}}`,
+			hidden: []string{"letmein"},
+			shown:  []string{"192.168.123.1"},
+		},
+		{
+			name:   "value",
+			event:  `{"level":"warn","error":"login of operator with hunter2 refused","message":"Failed"}`,
+			hidden: []string{"hunter2", "operator"},
+			shown:  []string{"login of [REDACTED] with [REDACTED] refused"},
+		},
+		{
+			name:   "stok",
+			event:  `{"level":"warn","error":"Get \"http://192.168.123.1/cgi-bin/luci/;stok=0123abcd/customer/status/wan/\": EOF"}`,
+			hidden: []string{"0123abcd"},
+			shown:  []string{";stok=[REDACTED]/customer/status/wan/"},
+		},
+		{
+			name:   "not JSON",
+			event:  "sysauth=abc; stok=0123abcd hunter2\n",
+			hidden: []string{"abc;", "0123abcd", "hunter2"},
+			shown:  []string{"sysauth=[REDACTED]"},
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if _, err := (redactWriter{next: &out}).Write([]byte(test.event)); err != nil {
+			t.Fatalf("%s: Write() = %v", test.name, err)
+		}
+		for _, s := range test.hidden {
+			if strings.Contains(out.String(), s) {
+				t.Errorf("%s: wrote %s, want %s masked", test.name, out.String(), s)
+			}
+		}
+		for _, s := range test.shown {
+			if !strings.Contains(out.String(), s) {
+				t.Errorf("%s: wrote %s, want %s", test.name, out.String(), s)
+			}
+		}
+	}
+}
+
+func TestRedactedValuesReplaced(t *testing.T) {
+	useSecrets(t, "old-password")
+	redactValues("typed", "typed", "")
+	secretsMu.RLock()
+	added := len(secretValues)
+	secretsMu.RUnlock()
+	if added != 2 {
+		t.Errorf("masked %d values, want 2", added)
+	}
+
+	// Reloading config replaces them
+	setRedactedValues("new-password", "new-password")
+	if got := redactString("old-password new-password typed"); got != "old-password [REDACTED] typed" {
+		t.Errorf("redactString() = %q", got)
+	}
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	if len(secretValues) != 1 {
+		t.Errorf("masked values = %q, want the new password once", secretValues)
+	}
+}
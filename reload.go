@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"github.com/fsnotify/fsnotify"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// reloadDebounce is how long config.ini has to stay unchanged before it's reloaded, editors write in bursts
+const reloadDebounce = time.Millisecond * 500
+
+// Reloader keeps the config and the Outputs running, and reloads them on demand or when config.ini changes.
+// An invalid config is rejected, and the last good one keeps running.
+type Reloader struct {
+	pollers  []*Poller  // One per router, in the order of the config
+	reloadMu sync.Mutex // Serializes Reload
+	watcher  *fsnotify.Watcher
+	onReload []func(config *Config)
+
+	mu      sync.RWMutex
+	config  *Config
+	outputs *Outputs
+}
+
+// NewReloader starts the outputs of config, Consume should be added to consumers of pollers
+func NewReloader(config *Config, pollers []*Poller) (*Reloader, error) {
+	outputs, err := StartOutputs(config, pollers, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Reloader{
+		pollers: pollers,
+		config:  config,
+		outputs: outputs,
+	}, nil
+}
+
+// Consume hands a captured state to the current outputs, it's meant to be a Poller consumer
+func (r *Reloader) Consume(state *State) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.outputs.Consume(state)
+}
+
+// Outputs are the outputs currently running, they are replaced when their config changes
+func (r *Reloader) Outputs() *Outputs {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.outputs
+}
+
+// OnReload adds a callback, called after every successful reload
+func (r *Reloader) OnReload(callback func(config *Config)) {
+	r.onReload = append(r.onReload, callback)
+}
+
+// Reload loads the config again and applies it: log level, routers, credentials with a fresh login,
+// intervals, rules and retries. Outputs whose config changed are restarted, taking over ongoing outages,
+// pending transitions and undelivered webhook events. Routers are matched in
+// order, adding or removing some needs a restart.
+func (r *Reloader) Reload() error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	config, err := LoadConfig()
+	if err == nil && len(config.Routers) != len(r.pollers) {
+		err = errors.New("routers were added or removed, restart to apply")
+	}
+	if err != nil {
+		logger.Error().Err(err).Msg("Invalid config, keeping the last good one")
+		r.Outputs().Notify("OTECStar: config not reloaded", err.Error())
+		return err
+	}
+
+	// New outputs are started aside, consumers only wait for the switch, not for listeners and brokers
+	last := r.Outputs()
+	outputs := last
+	if outputsChanged(r.config, &config) {
+		if outputs, err = StartOutputs(&config, r.pollers, last); err != nil {
+			logger.Error().Err(err).Msg("Failed to start outputs, keeping the last good config")
+			last.Notify("OTECStar: config not reloaded", err.Error())
+			return err
+		}
+	}
+	r.mu.Lock()
+	if outputs != last {
+		// Along with the switch, so that no state is consumed by last meanwhile
+		outputs.Adopt(last)
+	}
+	r.config, r.outputs = &config, outputs
+	r.mu.Unlock()
+	if outputs != last {
+		last.Close()
+	}
+
+	applyLogging(&config)
+	for i, poller := range r.pollers {
+		poller.Reconfigure(&config, config.Routers[i])
+	}
+	logger.Info().Msg("Config reloaded")
+	for _, callback := range r.onReload {
+		callback(&config)
+	}
+	return nil
+}
+
+// outputsChanged tells whether the config of any output differs between a and b, routers included
+func outputsChanged(a, b *Config) bool {
+	return !reflect.DeepEqual(routerAddresses(a), routerAddresses(b)) ||
+		!reflect.DeepEqual(a.HTTP, b.HTTP) ||
+		!reflect.DeepEqual(a.History, b.History) ||
+		!reflect.DeepEqual(a.Notify, b.Notify) ||
+		!reflect.DeepEqual(a.MQTT, b.MQTT) ||
+		!reflect.DeepEqual(a.Webhooks, b.Webhooks)
+}
+
+// routerAddresses are the names and IPs of the routers of config, which outputs label states with
+func routerAddresses(config *Config) []string {
+	var addresses []string
+	for _, router := range config.Routers {
+		addresses = append(addresses, router.Name+"="+router.RouterIP)
+	}
+	return addresses
+}
+
+// Watch reloads the config whenever config.ini changes, until Close. There is nothing to watch without a file.
+func (r *Reloader) Watch() error {
+	path := r.config.file
+	if path == "" {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watching the directory catches editors which replace the file instead of writing to it
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	r.watcher = watcher
+	go r.watch(filepath.Clean(path))
+	logger.Debug().Str("path", path).Msg("Watching config")
+	return nil
+}
+
+func (r *Reloader) watch(path string) {
+	var timer *time.Timer
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+			if filepath.Clean(event.Name) != path || event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(reloadDebounce, func() {
+				logger.Info().Str("path", path).Msg("Config changed")
+				_ = r.Reload()
+			})
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn().Err(err).Msg("Failed to watch config")
+		}
+	}
+}
+
+// Close stops watching, and shuts the outputs down
+func (r *Reloader) Close() {
+	if r.watcher != nil {
+		r.watcher.Close()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outputs.Close()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"otecstar/router"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookEndpoint records the events posted to it, and fails with 503 while down
+type webhookEndpoint struct {
+	mu       sync.Mutex
+	down     bool
+	attempts int
+	events   []WebhookEvent
+}
+
+func (e *webhookEndpoint) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var event struct {
+		From   Health    `json:"from"`
+		To     Health    `json:"to"`
+		At     time.Time `json:"at"`
+		Router string    `json:"router"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.attempts++
+	if e.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	e.events = append(e.events, WebhookEvent{Transition: Transition{From: event.From, To: event.To, At: event.At}, Router: event.Router})
+}
+
+func (e *webhookEndpoint) setDown(down bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.down = down
+}
+
+func (e *webhookEndpoint) counts() (attempts, events int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.attempts, len(e.events)
+}
+
+// testState is a state of the router of the test config, with given health
+func testState(health Health, at time.Time) *State {
+	status := router.WANStatus{WAN: router.Connected, Link: router.Connected}
+	if health == HealthError {
+		status.WAN = router.Disconnected
+	}
+	return &State{
+		State:  router.State{WANStatus: status, Router: "192.168.123.1", CapturedAt: at},
+		Health: health,
+	}
+}
+
+func TestReloadKeepsOutagesAndWebhookEvents(t *testing.T) {
+	endpoint := &webhookEndpoint{down: true}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	dir := useConfigDir(t)
+	writeConfig := func(maxBackoff, outages string) {
+		content := fmt.Sprintf(`[auth]
+router_ip = 192.168.123.1
+[history]
+retention = %s
+outages_path = %s
+[notify]
+enabled = false
+[webhook "team"]
+url = %s
+debounce = 0s
+max_backoff = %s
+`, maxBackoff, filepath.Join(dir, outages), server.URL, maxBackoff)
+		if err := ioutil.WriteFile(filepath.Join(dir, "config.ini"), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("1m", "outages.jsonl")
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := NewReloader(&config, NewPollers(&config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloader.Close()
+
+	// The line goes down, and the endpoint is unreachable meanwhile
+	start := time.Now().Add(-time.Minute)
+	reloader.Consume(testState(HealthOK, start.Add(-time.Second)))
+	reloader.Consume(testState(HealthError, start))
+	waitFor(t, "a delivery attempt", func() bool {
+		attempts, _ := endpoint.counts()
+		return attempts > 0
+	})
+
+	// Changing the outage log and the webhook starts them anew
+	writeConfig("2m", "moved.jsonl")
+	last := reloader.Outputs()
+	history := last.history
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	outputs := reloader.Outputs()
+	if outputs == last || outputs.webhooks[0] == last.webhooks[0] || outputs.outages == last.outages {
+		t.Fatal("outputs were not started anew")
+	}
+	// History of the same path is kept, with the new retention
+	outputs.history.mu.Lock()
+	retention := outputs.history.config.Retention
+	outputs.history.mu.Unlock()
+	if outputs.history != history || retention != time.Minute*2 {
+		t.Errorf("history retention = %s, want the history kept with the new retention", retention)
+	}
+	if current := outputs.outages.Current("192.168.123.1"); current == nil || !current.Start.Equal(start) {
+		t.Fatalf("ongoing outage = %+v, want the one started before reloading", current)
+	}
+
+	endpoint.setDown(false)
+	end := time.Now()
+	reloader.Consume(testState(HealthError, end.Add(-time.Second)))
+	reloader.Consume(testState(HealthOK, end))
+	waitFor(t, "both events", func() bool {
+		_, events := endpoint.counts()
+		return events >= 2
+	})
+	endpoint.mu.Lock()
+	events := endpoint.events
+	endpoint.mu.Unlock()
+	if len(events) != 2 || events[0].To != HealthError || !events[0].At.Equal(start) || events[1].From != HealthError || events[1].To != HealthOK {
+		t.Errorf("events = %+v, want the outage queued before reloading, then the recovery", events)
+	}
+
+	outages, err := outputs.outages.Since(start.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outages) != 1 || !outages[0].Start.Equal(start) || outages[0].End == nil || !outages[0].End.Equal(end) || outages[0].Interrupted {
+		t.Errorf("outages = %+v, want a single one ended after reloading", outages)
+	}
+}
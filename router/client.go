@@ -0,0 +1,350 @@
+// Package router implements a client for the web interface of OTECStar devices.
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/rs/zerolog"
+	zlog "github.com/rs/zerolog/log"
+	"golang.org/x/net/html"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrLoginFailed is returned when the router does not hand out a session cookie
+	ErrLoginFailed = errors.New("failed to login")
+	// ErrSessionExpired is returned when the router answers with its login form instead of the WAN page
+	ErrSessionExpired = errors.New("session expired")
+	// ErrUnexpectedFormat is returned when the WAN page does not look like what we know
+	ErrUnexpectedFormat = errors.New("unexpected data table format")
+	// ErrNoLoginPage is returned by Probe when the address answers with something else than the login page
+	ErrNoLoginPage = errors.New("no LuCI login page")
+)
+
+// Failure kinds, see Classify
+const (
+	// FailureNetwork means the router could not be reached, or did not answer in time
+	FailureNetwork = "network"
+	// FailureAuth means the router refused the credentials
+	FailureAuth = "auth"
+	// FailureSession means the session expired again right after logging in
+	FailureSession = "session"
+	// FailureFormat means the router answered with a page we don't understand
+	FailureFormat = "format"
+	// FailureOther is anything else
+	FailureOther = "other"
+)
+
+// Classify tells the kind of a failure returned by Client
+func Classify(err error) string {
+	var urlErr *url.Error
+	switch {
+	case errors.Is(err, ErrLoginFailed):
+		return FailureAuth
+	case errors.Is(err, ErrSessionExpired):
+		return FailureSession
+	case errors.Is(err, ErrUnexpectedFormat), errors.Is(err, ErrNoLoginPage):
+		return FailureFormat
+	case errors.As(err, &urlErr):
+		return FailureNetwork
+	default:
+		return FailureOther
+	}
+}
+
+// Stats counts what happened to a Client so far
+type Stats struct {
+	LoginAttempts   uint64 `json:"login_attempts"`
+	LoginFailures   uint64 `json:"login_failures"`
+	SessionExpiries uint64 `json:"session_expiries"`
+	FetchFailures   uint64 `json:"fetch_failures"`
+	// Failed fetches by kind, see Classify
+	NetworkFailures uint64 `json:"network_failures"`
+	AuthFailures    uint64 `json:"auth_failures"`
+	SessionFailures uint64 `json:"session_failures"`
+	FormatFailures  uint64 `json:"format_failures"`
+}
+
+// Client talks to the LuCI web interface of an OTECStar router
+type Client struct {
+	stats Stats // Accessed atomically, keep it first for 64-bit alignment on 32-bit platforms
+
+	routerIP      string
+	username      string
+	password      string
+	loginUrl      string
+	stateUrl      string
+	sysauthCookie *http.Cookie
+	httpClient    *http.Client
+	logger        zerolog.Logger
+}
+
+// NewClient constructs a Client for the router at routerIP, authenticating with given credentials
+func NewClient(routerIP, username, password string) *Client {
+	return &Client{
+		routerIP:   routerIP,
+		username:   username,
+		password:   password,
+		loginUrl:   "http://%s/cgi-bin/luci/customer/",
+		httpClient: &http.Client{Timeout: time.Second * 5},
+		logger:     zlog.Logger.With().Str("module", "router").Logger(),
+	}
+}
+
+// SetCredentials changes the router and credentials to login with, the session is dropped so the next
+// request logs in afresh. It must not be called concurrently with requests.
+func (c *Client) SetCredentials(routerIP, username, password string) {
+	c.routerIP = routerIP
+	c.username = username
+	c.password = password
+	c.sysauthCookie = nil
+}
+
+// SetTimeouts sets how long connecting to the router may take, and then how long it may take to respond
+func (c *Client) SetTimeouts(connect, read time.Duration) {
+	c.httpClient.CloseIdleConnections()
+	c.httpClient = &http.Client{
+		Timeout: connect + read,
+		Transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: connect}).DialContext,
+			ResponseHeaderTimeout: read,
+			MaxIdleConnsPerHost:   1,
+			IdleConnTimeout:       time.Minute,
+		},
+	}
+}
+
+// LoggedIn tells whether the client currently holds a session
+func (c *Client) LoggedIn() bool {
+	return c.sysauthCookie != nil
+}
+
+// Login authenticates against the router, and keeps the session for future requests
+func (c *Client) Login(ctx context.Context) error {
+	/**
+	Login: POST http://{ROUTER_IP}/cgi-bin/luci/customer/ with {username, password, login_in=登录}
+	Login returns cookies: sysauth={SYS_AUTH}; path=/cgi-bin/luci/;stok={STOCK}
+	Get state from this page: http://{ROUTER_IP}/cgi-bin/luci/;stok={STOCK}/customer/status/wan/
+	If form#sysauth[name="sysauth"] is presented in responding HTML, it means we need to login again.
+	*/
+	data := url.Values{}
+	data.Set("username", c.username)
+	data.Set("password", c.password)
+	data.Set("login_in", "登录")
+
+	postData := bytes.Buffer{}
+	postData.WriteString(data.Encode())
+
+	c.logger.Debug().Msg("login")
+	c.sysauthCookie = nil
+	atomic.AddUint64(&c.stats.LoginAttempts, 1)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf(c.loginUrl, c.routerIP), &postData)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		atomic.AddUint64(&c.stats.LoginFailures, 1)
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Golang http does not honor `;` in cookie values, so we must do this manually
+	for _, header := range resp.Header.Values("set-cookie") {
+		for _, cookieStr := range strings.Split(header, "; ") {
+			c.logger.Debug().Str("cookieStr", cookieStr).Msg("Processing...")
+			_c := strings.SplitN(cookieStr, "=", 2)
+			if len(_c) != 2 {
+				c.logger.Debug().Str("cookie", cookieStr).Msg("Skipped bad cookie string")
+				continue
+			}
+			name, value := _c[0], _c[1]
+			if name == `path` {
+				c.stateUrl = fmt.Sprintf(`http://%%s/%s/customer/status/wan/`, strings.TrimPrefix(value, "/"))
+				c.logger.Debug().Str("stateUrl", c.stateUrl).Msg("stateUrl updated")
+				continue
+			}
+			if name == `sysauth` {
+				c.sysauthCookie = &http.Cookie{Name: name, Value: value}
+				c.logger.Debug().Msg("Got sysauth cookie")
+			}
+		}
+	}
+
+	if c.sysauthCookie == nil {
+		atomic.AddUint64(&c.stats.LoginFailures, 1)
+		return ErrLoginFailed
+	}
+	c.logger.Debug().Interface("sysauthCookie", c.sysauthCookie).Msg("login OK")
+	return nil
+}
+
+// Probe checks that the router serves the LuCI login page of OTECStar devices, without logging in
+func (c *Client) Probe(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(c.loginUrl, c.routerIP), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to parse login page: %w", err)
+	}
+	if doc.Find(`form#sysauth`).Length() == 0 {
+		return ErrNoLoginPage
+	}
+	return nil
+}
+
+// FetchWANStatus reads the WAN status page, logging in first if there is no session yet.
+// If the session turned out to be expired, it logs in again and retries once.
+func (c *Client) FetchWANStatus(ctx context.Context) (*WANStatus, error) {
+	status, err := c.fetchWANStatus(ctx)
+	if errors.Is(err, ErrSessionExpired) {
+		c.logger.Info().Msg("Login expired, retrying")
+		atomic.AddUint64(&c.stats.SessionExpiries, 1)
+		status, err = c.fetchWANStatus(ctx)
+	}
+	if err != nil {
+		atomic.AddUint64(&c.stats.FetchFailures, 1)
+		switch Classify(err) {
+		case FailureNetwork:
+			atomic.AddUint64(&c.stats.NetworkFailures, 1)
+		case FailureAuth:
+			atomic.AddUint64(&c.stats.AuthFailures, 1)
+		case FailureSession:
+			atomic.AddUint64(&c.stats.SessionFailures, 1)
+		case FailureFormat:
+			atomic.AddUint64(&c.stats.FormatFailures, 1)
+		}
+	}
+	return status, err
+}
+
+func (c *Client) fetchWANStatus(ctx context.Context) (*WANStatus, error) {
+	c.logger.Debug().Msg("FetchWANStatus")
+	if c.sysauthCookie == nil {
+		if err := c.Login(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(c.stateUrl, c.routerIP), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.AddCookie(c.sysauthCookie)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access WAN state page: %w", withoutToken(err))
+	}
+	defer resp.Body.Close()
+
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse WAN page response: %w", err)
+	}
+
+	// Check state response, if our authentication expired, the login form is shown instead
+	if doc.Find(`form#sysauth`).Length() > 0 {
+		c.sysauthCookie = nil
+		return nil, ErrSessionExpired
+	}
+	return ParseWANStatus(doc)
+}
+
+// ParseWANStatus extracts WAN information from a parsed WAN status page
+func ParseWANStatus(doc *goquery.Document) (*WANStatus, error) {
+	dataTables := doc.Find(`table.cbi-table-list`)
+	if dataTables.Length() != 4 {
+		return nil, ErrUnexpectedFormat
+	}
+	linkTable := dataTables.Eq(3).Find(`td.cbi-table-field`)
+	if linkTable.Length() < 6 {
+		return nil, ErrUnexpectedFormat
+	}
+	return &WANStatus{
+		WAN:      ParseConnState(dataTables.Eq(2).Find(`td.cbi-table-field`).Last().Text()),
+		Link:     ParseConnState(getText(linkTable.Get(0))),
+		LinkLoss: parseReading(getText(linkTable.Get(1))),
+		UpRate:   parseReading(getText(linkTable.Get(2))),
+		DownRate: parseReading(getText(linkTable.Get(3))),
+		UpSNR:    parseReading(getText(linkTable.Get(4))),
+		DownSNR:  parseReading(getText(linkTable.Get(5))),
+	}, nil
+}
+
+// stokSegment is the session token in the path of the WAN page
+var stokSegment = regexp.MustCompile(`;stok=[^/?#]*`)
+
+// withoutToken leaves the session token out of the URL of err, since errors end up in logs, files and messages
+func withoutToken(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+	redacted := *urlErr
+	redacted.URL = stokSegment.ReplaceAllString(urlErr.URL, ";stok=[REDACTED]")
+	return &redacted
+}
+
+// Stats returns a copy of the counters, it is safe to call concurrently with other methods
+func (c *Client) Stats() Stats {
+	return Stats{
+		LoginAttempts:   atomic.LoadUint64(&c.stats.LoginAttempts),
+		LoginFailures:   atomic.LoadUint64(&c.stats.LoginFailures),
+		SessionExpiries: atomic.LoadUint64(&c.stats.SessionExpiries),
+		FetchFailures:   atomic.LoadUint64(&c.stats.FetchFailures),
+		NetworkFailures: atomic.LoadUint64(&c.stats.NetworkFailures),
+		AuthFailures:    atomic.LoadUint64(&c.stats.AuthFailures),
+		SessionFailures: atomic.LoadUint64(&c.stats.SessionFailures),
+		FormatFailures:  atomic.LoadUint64(&c.stats.FormatFailures),
+	}
+}
+
+// Capture fetches the WAN status and wraps it into a State, errors are recorded in State.Err
+func (c *Client) Capture(ctx context.Context) *State {
+	state := State{CapturedAt: time.Now()}
+	status, err := c.FetchWANStatus(ctx)
+	state.RoundTrip = time.Since(state.CapturedAt)
+	if err != nil {
+		state.Err = err
+		state.WANStatus = unknownWANStatus()
+		return &state
+	}
+	state.WANStatus = *status
+	return &state
+}
+
+// Close drops the current session and releases idle connections
+func (c *Client) Close() {
+	c.sysauthCookie = nil
+	c.httpClient.CloseIdleConnections()
+}
+
+func getText(node *html.Node) (t string) {
+	if node.Type == html.TextNode {
+		t = node.Data
+		return
+	}
+
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		t += getText(c)
+	}
+	return
+}
@@ -0,0 +1,264 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"math"
+	"net/http/httptest"
+	"otecstar/router/fakerouter"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient starts a fake router and a Client of it, logging in with password
+func newTestClient(t *testing.T, password string) (*Client, *fakerouter.Router) {
+	fake := fakerouter.New("admin", "secret")
+	server := fakerouter.NewServer(fake)
+	t.Cleanup(server.Close)
+	client := NewClient(server.Listener.Addr().String(), "admin", password)
+	client.SetTimeouts(time.Second, time.Second)
+	t.Cleanup(client.Close)
+	return client, fake
+}
+
+func TestLogin(t *testing.T) {
+	client, fake := newTestClient(t, "secret")
+	if err := client.Login(context.Background()); err != nil {
+		t.Fatalf("Login() = %v", err)
+	}
+	if !client.LoggedIn() {
+		t.Error("LoggedIn() = false after logging in")
+	}
+	if logins := fake.Logins(); logins != 1 {
+		t.Errorf("router saw %d logins, want 1", logins)
+	}
+}
+
+func TestLoginWrongPassword(t *testing.T) {
+	client, fake := newTestClient(t, "wrong")
+	err := client.Login(context.Background())
+	if !errors.Is(err, ErrLoginFailed) {
+		t.Fatalf("Login() = %v, want ErrLoginFailed", err)
+	}
+	if client.LoggedIn() {
+		t.Error("LoggedIn() = true after a failed login")
+	}
+	if logins := fake.Logins(); logins != 0 {
+		t.Errorf("router saw %d logins, want 0", logins)
+	}
+	if stats := client.Stats(); stats.LoginAttempts != 1 || stats.LoginFailures != 1 {
+		t.Errorf("Stats() = %+v, want 1 attempt and 1 failure", stats)
+	}
+}
+
+func TestFetchWANStatus(t *testing.T) {
+	client, _ := newTestClient(t, "secret")
+	status, err := client.FetchWANStatus(context.Background())
+	if err != nil {
+		t.Fatalf("FetchWANStatus() = %v", err)
+	}
+	want := WANStatus{WAN: Connected, Link: Connected, LinkLoss: 12.5, UpRate: 40, DownRate: 100, UpSNR: 9.8, DownSNR: 11.2}
+	if *status != want {
+		t.Errorf("FetchWANStatus() = %+v, want %+v", *status, want)
+	}
+}
+
+func TestSessionExpiryLogsInAgain(t *testing.T) {
+	client, fake := newTestClient(t, "secret")
+	ctx := context.Background()
+	if _, err := client.FetchWANStatus(ctx); err != nil {
+		t.Fatalf("first FetchWANStatus() = %v", err)
+	}
+
+	fake.ExpireSessions()
+	fake.SetDown(true)
+	status, err := client.FetchWANStatus(ctx)
+	if err != nil {
+		t.Fatalf("FetchWANStatus() after expiry = %v", err)
+	}
+	if status.WAN != Disconnected {
+		t.Errorf("WAN = %s, want the page of the new session", status.WAN)
+	}
+	if logins := fake.Logins(); logins != 2 {
+		t.Errorf("router saw %d logins, want 2", logins)
+	}
+	if stats := client.Stats(); stats.SessionExpiries != 1 || stats.FetchFailures != 0 {
+		t.Errorf("Stats() = %+v, want 1 session expiry and no failure", stats)
+	}
+}
+
+func TestCaptureRecordsErrors(t *testing.T) {
+	client, fake := newTestClient(t, "secret")
+	fake.SetMalformed(true)
+	state := client.Capture(context.Background())
+	if !errors.Is(state.Err, ErrUnexpectedFormat) {
+		t.Fatalf("Capture().Err = %v, want ErrUnexpectedFormat", state.Err)
+	}
+	if state.CapturedAt.IsZero() || state.WAN != Unknown || state.Link != Unknown {
+		t.Errorf("Capture() = %+v, want a timestamp and unknown states", state)
+	}
+	for _, v := range []float64{state.LinkLoss, state.UpRate, state.UpSNR, state.DownRate, state.DownSNR} {
+		if !math.IsNaN(v) {
+			t.Errorf("Capture() = %+v, want unknown readings", state)
+			break
+		}
+	}
+}
+
+func TestFetchErrorsHideToken(t *testing.T) {
+	client, fake := newTestClient(t, "secret")
+	if err := client.Login(context.Background()); err != nil {
+		t.Fatalf("Login() = %v", err)
+	}
+	stok := stokSegment.FindString(client.stateUrl)
+	if stok == "" {
+		t.Fatalf("no token in %s", client.stateUrl)
+	}
+	fake.SetUnreachable(true)
+	_, err := client.FetchWANStatus(context.Background())
+	if err == nil {
+		t.Fatal("FetchWANStatus() of an unreachable router succeeded")
+	}
+	if strings.Contains(err.Error(), stok) || !strings.Contains(err.Error(), ";stok=[REDACTED]") {
+		t.Errorf("FetchWANStatus() = %v, want the token left out", err)
+	}
+	if kind := Classify(err); kind != FailureNetwork {
+		t.Errorf("Classify(%v) = %s, want %s", err, kind, FailureNetwork)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	client, _ := newTestClient(t, "")
+	if err := client.Probe(context.Background()); err != nil {
+		t.Errorf("Probe() of the fake router = %v", err)
+	}
+
+	other := httptest.NewServer(nil)
+	defer other.Close()
+	client = NewClient(other.Listener.Addr().String(), "", "")
+	if err := client.Probe(context.Background()); !errors.Is(err, ErrNoLoginPage) {
+		t.Errorf("Probe() of another server = %v, want ErrNoLoginPage", err)
+	}
+}
+
+// wanPage is a WAN page with the given texts in the link table
+func wanPage(wan string, link ...string) string {
+	var b strings.Builder
+	b.WriteString(`<html><body><div class="cbi-map">`)
+	for _, field := range []string{"PPPoE", "-", wan} {
+		fmt.Fprintf(&b, `<table class="cbi-table-list"><tr><td class="cbi-table-field">x</td><td class="cbi-table-field">%s</td></tr></table>`, field)
+	}
+	b.WriteString(`<table class="cbi-table-list"><tr>`)
+	for _, field := range link {
+		fmt.Fprintf(&b, `<td class="cbi-table-field">%s</td>`, field)
+	}
+	b.WriteString(`</tr></table></div></body></html>`)
+	return b.String()
+}
+
+func TestParseWANStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want WANStatus
+		err  error
+	}{
+		{
+			name: "connected",
+			page: wanPage("连接上", "<span>连接上</span>", "12.5 dB", "40.0", "100.0", "9.8", "11.2"),
+			want: WANStatus{WAN: Connected, Link: Connected, LinkLoss: 12.5, UpRate: 40, DownRate: 100, UpSNR: 9.8, DownSNR: 11.2},
+		},
+		{
+			name: "down",
+			page: wanPage("未连接", "未连接", "0", "0", "0", "0", "0"),
+			want: WANStatus{WAN: Disconnected, Link: Disconnected},
+		},
+		{
+			name: "no tables",
+			page: `<html><body><div class="cbi-map">维护中</div></body></html>`,
+			err:  ErrUnexpectedFormat,
+		},
+		{
+			name: "short link table",
+			page: wanPage("连接上", "连接上", "12.5"),
+			err:  ErrUnexpectedFormat,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc, err := goquery.NewDocumentFromReader(strings.NewReader(test.page))
+			if err != nil {
+				t.Fatal(err)
+			}
+			status, err := ParseWANStatus(doc)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("ParseWANStatus() = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseWANStatus() = %v", err)
+			}
+			if *status != test.want {
+				t.Errorf("ParseWANStatus() = %+v, want %+v", *status, test.want)
+			}
+		})
+	}
+}
+
+func TestParseWANStatusUnknownReadings(t *testing.T) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(wanPage("连接上", "连接上", "-", "N/A", "", "9.8", "11.2")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := ParseWANStatus(doc)
+	if err != nil {
+		t.Fatalf("ParseWANStatus() = %v", err)
+	}
+	for name, v := range map[string]float64{"LinkLoss": status.LinkLoss, "UpRate": status.UpRate, "DownRate": status.DownRate} {
+		if !math.IsNaN(v) {
+			t.Errorf("%s = %v, want NaN", name, v)
+		}
+	}
+	if status.UpSNR != 9.8 {
+		t.Errorf("UpSNR = %v, want 9.8", status.UpSNR)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	client, fake := newTestClient(t, "secret")
+	ctx := context.Background()
+
+	wrong, _ := newTestClient(t, "wrong")
+	_, authErr := wrong.FetchWANStatus(ctx)
+
+	fake.SetMalformed(true)
+	_, formatErr := client.FetchWANStatus(ctx)
+	fake.SetMalformed(false)
+
+	fake.SetUnreachable(true)
+	_, networkErr := client.FetchWANStatus(ctx)
+	fake.SetUnreachable(false)
+
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"wrong password", authErr, FailureAuth},
+		{"malformed page", formatErr, FailureFormat},
+		{"dropped connection", networkErr, FailureNetwork},
+		{"no login page", ErrNoLoginPage, FailureFormat},
+		{"expired session", fmt.Errorf("fetch: %w", ErrSessionExpired), FailureSession},
+		{"anything else", errors.New("boom"), FailureOther},
+	}
+	for _, test := range tests {
+		if got := Classify(test.err); got != test.want {
+			t.Errorf("Classify(%s: %v) = %s, want %s", test.name, test.err, got, test.want)
+		}
+	}
+}
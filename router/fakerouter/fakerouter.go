@@ -0,0 +1,302 @@
+// Package fakerouter simulates the web interface of an OTECStar router, for development and tests without a device.
+package fakerouter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status is what the fake router shows on its WAN page, in the same text form as a real one
+type Status struct {
+	WANState  string
+	LinkState string
+	LinkLoss  string
+	UpRate    string
+	DownRate  string
+	UpSNR     string
+	DownSNR   string
+}
+
+// DefaultStatus is a healthy line
+var DefaultStatus = Status{
+	WANState:  "连接上",
+	LinkState: "连接上",
+	LinkLoss:  "12.5",
+	UpRate:    "40.0",
+	DownRate:  "100.0",
+	UpSNR:     "9.8",
+	DownSNR:   "11.2",
+}
+
+// DownStatus is what a real router shows when the line is down
+var DownStatus = Status{
+	WANState:  "未连接",
+	LinkState: "未连接",
+	LinkLoss:  "0",
+	UpRate:    "0",
+	DownRate:  "0",
+	UpSNR:     "0",
+	DownSNR:   "0",
+}
+
+// Router is a fake OTECStar router. It is safe for concurrent use.
+// Besides the LuCI pages, it serves control endpoints under /_fake/ so it can be scripted over HTTP:
+//
+//	POST /_fake/expire              expire all sessions
+//	POST /_fake/down?on=1|0         switch between DownStatus and the normal status
+//	POST /_fake/unreachable?on=1|0  drop every connection without responding
+//	POST /_fake/malformed?on=1|0    serve a WAN page without data tables
+//	POST /_fake/delay?d=2s          delay every response
+//	POST /_fake/status?down_snr=5   change fields of the normal status
+type Router struct {
+	username string
+	password string
+
+	mu          sync.Mutex
+	status      Status
+	sessions    map[string]string // stok => sysauth
+	down        bool
+	unreachable bool
+	malformed   bool
+	delay       time.Duration
+	logins      int
+}
+
+// New creates a fake router accepting given credentials, showing DefaultStatus
+func New(username, password string) *Router {
+	return &Router{
+		username: username,
+		password: password,
+		status:   DefaultStatus,
+		sessions: map[string]string{},
+	}
+}
+
+// NewServer starts an httptest.Server serving r, its `Listener.Addr()` is what goes into `router_ip`
+func NewServer(r *Router) *httptest.Server {
+	return httptest.NewServer(r)
+}
+
+// SetStatus replaces the normal status
+func (r *Router) SetStatus(status Status) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+// ExpireSessions invalidates all sessions, the next WAN page request gets the login form
+func (r *Router) ExpireSessions() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions = map[string]string{}
+}
+
+// SetDown makes the WAN page show DownStatus
+func (r *Router) SetDown(down bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.down = down
+}
+
+// SetUnreachable makes the router drop connections without responding
+func (r *Router) SetUnreachable(unreachable bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unreachable = unreachable
+}
+
+// SetMalformed makes the WAN page come without data tables
+func (r *Router) SetMalformed(malformed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.malformed = malformed
+}
+
+// SetDelay delays every response by d
+func (r *Router) SetDelay(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delay = d
+}
+
+// Logins tells how many successful logins happened so far
+func (r *Router) Logins() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.logins
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, "/_fake/") {
+		r.serveControl(w, req)
+		return
+	}
+
+	r.mu.Lock()
+	delay, unreachable := r.delay, r.unreachable
+	r.mu.Unlock()
+
+	if delay > 0 {
+		// The server only notices a client giving up once the body is read
+		_ = req.ParseForm()
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	if unreachable {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		http.Error(w, "unreachable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if req.URL.Path == "/cgi-bin/luci/customer/" {
+		r.serveLogin(w, req)
+		return
+	}
+	// WAN page lives at /cgi-bin/luci/;stok={STOK}/customer/status/wan/
+	if stok, ok := parseStok(req.URL.Path); ok {
+		r.serveWAN(w, req, stok)
+		return
+	}
+	http.NotFound(w, req)
+}
+
+func (r *Router) serveLogin(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if req.Method != http.MethodPost ||
+		req.PostFormValue("username") != r.username ||
+		req.PostFormValue("password") != r.password {
+		_ = loginPage.Execute(w, nil)
+		return
+	}
+
+	stok, sysauth := randomToken(), randomToken()
+	r.mu.Lock()
+	r.sessions[stok] = sysauth
+	r.logins++
+	r.mu.Unlock()
+
+	// A real router puts `;stok=` right into the cookie path, which is not a valid cookie attribute
+	w.Header().Add("Set-Cookie", fmt.Sprintf("sysauth=%s; path=/cgi-bin/luci/;stok=%s", sysauth, stok))
+	_ = loginPage.Execute(w, nil)
+}
+
+func (r *Router) serveWAN(w http.ResponseWriter, req *http.Request, stok string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	r.mu.Lock()
+	sysauth, ok := r.sessions[stok]
+	status, malformed := r.status, r.malformed
+	if r.down {
+		status = DownStatus
+	}
+	r.mu.Unlock()
+
+	if cookie, err := req.Cookie("sysauth"); !ok || err != nil || cookie.Value != sysauth {
+		_ = loginPage.Execute(w, nil)
+		return
+	}
+	if malformed {
+		_, _ = w.Write([]byte("<html><body><div class=\"cbi-map\">维护中"))
+		return
+	}
+	_ = wanPage.Execute(w, status)
+}
+
+func (r *Router) serveControl(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	on := req.FormValue("on") != "0"
+
+	switch strings.TrimPrefix(req.URL.Path, "/_fake/") {
+	case "expire":
+		r.ExpireSessions()
+	case "down":
+		r.SetDown(on)
+	case "unreachable":
+		r.SetUnreachable(on)
+	case "malformed":
+		r.SetMalformed(on)
+	case "delay":
+		d, err := time.ParseDuration(req.FormValue("d"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.SetDelay(d)
+	case "status":
+		r.mu.Lock()
+		for key, field := range map[string]*string{
+			"wan_state":  &r.status.WANState,
+			"link_state": &r.status.LinkState,
+			"link_loss":  &r.status.LinkLoss,
+			"up_rate":    &r.status.UpRate,
+			"down_rate":  &r.status.DownRate,
+			"up_snr":     &r.status.UpSNR,
+			"down_snr":   &r.status.DownSNR,
+		} {
+			if value, ok := req.Form[key]; ok {
+				*field = value[0]
+			}
+		}
+		r.mu.Unlock()
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parseStok(path string) (string, bool) {
+	const prefix, suffix = "/cgi-bin/luci/;stok=", "/customer/status/wan/"
+	if !strings.HasPrefix(path, prefix) || !strings.HasSuffix(path, suffix) || len(path) <= len(prefix)+len(suffix) {
+		return "", false
+	}
+	return path[len(prefix) : len(path)-len(suffix)], true
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<html><body>
+<form method="post" action="/cgi-bin/luci/customer/" id="sysauth" name="sysauth">
+<input type="text" name="username"><input type="password" name="password">
+<input type="submit" name="login_in" value="登录">
+</form>
+</body></html>`))
+
+var wanPage = template.Must(template.New("wan").Parse(`<html><body><div class="cbi-map">
+<table class="cbi-section-table cbi-table-list"><tr><td class="cbi-table-field">WAN</td><td class="cbi-table-field">PPPoE</td></tr></table>
+<table class="cbi-section-table cbi-table-list"><tr><td class="cbi-table-field">IPv4</td><td class="cbi-table-field">-</td></tr></table>
+<table class="cbi-section-table cbi-table-list"><tr><td class="cbi-table-field">宽带状态</td><td class="cbi-table-field">{{.WANState}}</td></tr></table>
+<table class="cbi-section-table cbi-table-list"><tr>
+<td class="cbi-table-field"><span>{{.LinkState}}</span></td>
+<td class="cbi-table-field">{{.LinkLoss}}</td>
+<td class="cbi-table-field">{{.UpRate}}</td>
+<td class="cbi-table-field">{{.DownRate}}</td>
+<td class="cbi-table-field">{{.UpSNR}}</td>
+<td class="cbi-table-field">{{.DownSNR}}</td>
+</tr></table>
+</div></body></html>`))
@@ -0,0 +1,206 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ConnState is the state of the WAN or the link, as reported by the router
+type ConnState int
+
+const (
+	// Unknown means the state could not be determined, e.g. nothing was captured yet
+	Unknown ConnState = iota
+	// Connected means the router reports `连接上`
+	Connected
+	// Disconnected means the router reports anything other than `连接上`
+	Disconnected
+)
+
+// ParseConnState converts a state text shown on the WAN page into ConnState
+func ParseConnState(text string) ConnState {
+	switch text = strings.TrimSpace(text); text {
+	case `连接上`:
+		return Connected
+	case ``, `-`:
+		return Unknown
+	default:
+		return Disconnected
+	}
+}
+
+func (s ConnState) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes s as its String
+func (s ConnState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText decodes what MarshalText produces
+func (s *ConnState) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "connected":
+		*s = Connected
+	case "disconnected":
+		*s = Disconnected
+	case "unknown":
+		*s = Unknown
+	default:
+		return fmt.Errorf("unknown connection state %q", text)
+	}
+	return nil
+}
+
+// WANStatus is the WAN information shown on the router status page.
+// Attenuation and SNR are in dB, rates are in Mbps. Readings the router shows no number for are NaN.
+type WANStatus struct {
+	WAN      ConnState
+	Link     ConnState
+	LinkLoss float64
+	UpRate   float64
+	UpSNR    float64
+	DownRate float64
+	DownSNR  float64
+}
+
+// unknownWANStatus is a WANStatus of which nothing could be read
+func unknownWANStatus() WANStatus {
+	nan := math.NaN()
+	return WANStatus{LinkLoss: nan, UpRate: nan, UpSNR: nan, DownRate: nan, DownSNR: nan}
+}
+
+// State represents a captured state (snapshot) from the router
+type State struct {
+	WANStatus
+	// Router names the router the state was captured from, this package leaves it empty
+	Router string
+	// CapturedAt is when the capture started
+	CapturedAt time.Time
+	// RoundTrip is how long the capture took, including a login if there was one
+	RoundTrip time.Duration
+	// Err is set when the capture failed, in which case WAN and link are Unknown and readings are NaN
+	Err error
+}
+
+// OK tells whether both WAN and link are connected
+func (s *State) OK() bool {
+	return s.Err == nil && s.WAN == Connected && s.Link == Connected
+}
+
+// stateJSON is how State looks like in JSON
+type stateJSON struct {
+	Router     string    `json:"router,omitempty"`
+	CapturedAt time.Time `json:"captured_at"`
+	RoundTrip  float64   `json:"round_trip_seconds"`
+	Err        string    `json:"error,omitempty"`
+	WAN        ConnState `json:"wan"`
+	Link       ConnState `json:"link"`
+	// Readings are null when unknown, JSON has no NaN
+	LinkLoss *float64 `json:"link_loss_db"`
+	UpRate   *float64 `json:"up_rate_mbps"`
+	UpSNR    *float64 `json:"up_snr_db"`
+	DownRate *float64 `json:"down_rate_mbps"`
+	DownSNR  *float64 `json:"down_snr_db"`
+}
+
+// MarshalJSON encodes s as a flat object, Err becomes its message
+func (s State) MarshalJSON() ([]byte, error) {
+	j := stateJSON{
+		Router:     s.Router,
+		CapturedAt: s.CapturedAt,
+		RoundTrip:  s.RoundTrip.Seconds(),
+		WAN:        s.WAN,
+		Link:       s.Link,
+		LinkLoss:   knownReading(s.LinkLoss),
+		UpRate:     knownReading(s.UpRate),
+		UpSNR:      knownReading(s.UpSNR),
+		DownRate:   knownReading(s.DownRate),
+		DownSNR:    knownReading(s.DownSNR),
+	}
+	if s.Err != nil {
+		j.Err = s.Err.Error()
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes what MarshalJSON produces, Err only keeps the message
+func (s *State) UnmarshalJSON(data []byte) error {
+	var j stateJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*s = State{
+		WANStatus: WANStatus{
+			WAN:      j.WAN,
+			Link:     j.Link,
+			LinkLoss: readingOf(j.LinkLoss),
+			UpRate:   readingOf(j.UpRate),
+			UpSNR:    readingOf(j.UpSNR),
+			DownRate: readingOf(j.DownRate),
+			DownSNR:  readingOf(j.DownSNR),
+		},
+		Router:     j.Router,
+		CapturedAt: j.CapturedAt,
+		RoundTrip:  time.Duration(j.RoundTrip * float64(time.Second)),
+	}
+	if j.Err != "" {
+		s.Err = errors.New(j.Err)
+	}
+	return nil
+}
+
+// knownReading is v for JSON, nil when it's unknown
+func knownReading(v float64) *float64 {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return &v
+}
+
+// readingOf is what knownReading was given
+func readingOf(v *float64) float64 {
+	if v == nil {
+		return math.NaN()
+	}
+	return *v
+}
+
+// parseReading reads a reading shown on the WAN page, which is NaN when there is no number like `-` or `N/A`
+func parseReading(text string) float64 {
+	v, ok := parseNumber(text)
+	if !ok {
+		return math.NaN()
+	}
+	return v
+}
+
+// parseNumber reads the leading number of a text like `12.5` or `12.5 dB`, ok is false if there is none
+func parseNumber(text string) (v float64, ok bool) {
+	text = strings.TrimSpace(text)
+	end := strings.IndexFunc(text, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.' && r != '-' && r != '+'
+	})
+	if end >= 0 {
+		text = text[:end]
+	}
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// ruleMetrics are the readings rules can watch, by the name used in `metric`
+var ruleMetrics = map[string]func(state *State) float64{
+	"link_loss":  func(s *State) float64 { return s.LinkLoss },
+	"up_rate":    func(s *State) float64 { return s.UpRate },
+	"down_rate":  func(s *State) float64 { return s.DownRate },
+	"up_snr":     func(s *State) float64 { return s.UpSNR },
+	"down_snr":   func(s *State) float64 { return s.DownSNR },
+	"round_trip": func(s *State) float64 { return s.RoundTrip.Seconds() },
+}
+
+// ruleState is a rule along with how its reading went so far
+type ruleState struct {
+	*RuleConfig
+	value func(state *State) float64
+	// since is when the reading went out of bounds, zero while within
+	since time.Time
+	fired bool
+}
+
+// inBounds tells whether v is good, a fired rule needs v to be Hysteresis within bounds to recover
+func (r *ruleState) inBounds(v float64) bool {
+	margin := 0.0
+	if r.fired {
+		margin = r.Hysteresis
+	}
+	if r.Min != nil && v < *r.Min+margin {
+		return false
+	}
+	if r.Max != nil && v > *r.Max-margin {
+		return false
+	}
+	return true
+}
+
+// Rules judges the health of captured states with the rules of config, it remembers readings
+// for rules with a duration. It is not safe for concurrent use.
+type Rules struct {
+	rules []*ruleState
+}
+
+// NewRules constructs Rules, without any rule it judges like Evaluate does by default. Rules replace the
+// check of zero readings of judgeReadings, they only judge the readings they watch.
+func NewRules(configs []*RuleConfig) *Rules {
+	r := Rules{}
+	for _, config := range configs {
+		r.rules = append(r.rules, &ruleState{RuleConfig: config, value: ruleMetrics[config.Metric]})
+	}
+	return &r
+}
+
+// Judge sets Health and Reason of state. Rules are only checked while WAN and link are connected,
+// and start over once they are back.
+func (r *Rules) Judge(state *State) {
+	if !state.OK() || len(r.rules) == 0 {
+		for _, rule := range r.rules {
+			rule.since, rule.fired = time.Time{}, false
+		}
+		state.Health, state.Reason = judgeReadings(state), ""
+		return
+	}
+
+	health := HealthOK
+	var fired []string
+	for _, rule := range r.rules {
+		v := rule.value(state)
+		if math.IsNaN(v) {
+			// An unknown reading tells nothing, the rule stays as it was
+			if rule.fired {
+				fired = append(fired, rule.Name)
+				if level := Health(rule.Level); healthRank(level) > healthRank(health) {
+					health = level
+				}
+			}
+			continue
+		}
+		if rule.inBounds(v) {
+			rule.since, rule.fired = time.Time{}, false
+			continue
+		}
+		if rule.since.IsZero() {
+			rule.since = state.CapturedAt
+		}
+		if !rule.fired && state.CapturedAt.Sub(rule.since) < rule.For {
+			continue
+		}
+		rule.fired = true
+		fired = append(fired, rule.Name)
+		if level := Health(rule.Level); healthRank(level) > healthRank(health) {
+			health = level
+		}
+	}
+	state.Health, state.Reason = health, strings.Join(fired, "+")
+}
+
+// healthRank orders healths from good to bad
+func healthRank(h Health) int {
+	switch h {
+	case HealthOK:
+		return 0
+	case HealthWarn:
+		return 1
+	default:
+		return 2
+	}
+}
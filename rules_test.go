@@ -0,0 +1,131 @@
+package main
+
+import (
+	"otecstar/router"
+	"testing"
+	"time"
+)
+
+// ruleTestState is a connected state of the test router, with given downstream SNR and attenuation
+func ruleTestState(at time.Time, downSNR, linkLoss float64) *State {
+	return &State{State: router.State{
+		WANStatus: router.WANStatus{
+			WAN: router.Connected, Link: router.Connected,
+			DownSNR: downSNR, LinkLoss: linkLoss, UpSNR: 10, UpRate: 20, DownRate: 100,
+		},
+		Router:     "test",
+		CapturedAt: at,
+	}}
+}
+
+// bound is a pointer to v, for Min and Max of rules
+func bound(v float64) *float64 {
+	return &v
+}
+
+func TestRuleFiresAfterFor(t *testing.T) {
+	rules := NewRules([]*RuleConfig{
+		{Name: "snr", Metric: "down_snr", Min: bound(6), For: time.Minute, Level: string(HealthWarn)},
+	})
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	steps := []struct {
+		after   time.Duration
+		snr     float64
+		health  Health
+		comment string
+	}{
+		{0, 5, HealthOK, "crossed, but not for long yet"},
+		{time.Second * 30, 5, HealthOK, "still shorter than for"},
+		{time.Second * 40, 8, HealthOK, "back within bounds"},
+		{time.Second * 50, 5, HealthOK, "crossed again, counting from here"},
+		{time.Second * 100, 5, HealthOK, "50s since it crossed again"},
+		{time.Second * 110, 5, HealthWarn, "a minute since it crossed again"},
+	}
+	for _, step := range steps {
+		state := ruleTestState(start.Add(step.after), step.snr, 20)
+		rules.Judge(state)
+		if state.Health != step.health {
+			t.Errorf("%s: Health = %s, want %s", step.comment, state.Health, step.health)
+		}
+		if want := map[Health]string{HealthOK: "", HealthWarn: "snr"}[step.health]; state.Reason != want {
+			t.Errorf("%s: Reason = %q, want %q", step.comment, state.Reason, want)
+		}
+	}
+}
+
+func TestRuleHysteresis(t *testing.T) {
+	rules := NewRules([]*RuleConfig{
+		{Name: "snr", Metric: "down_snr", Min: bound(6), Hysteresis: 1.5, Level: string(HealthWarn)},
+	})
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	steps := []struct {
+		snr    float64
+		health Health
+	}{
+		{6, HealthOK},
+		{5.9, HealthWarn},
+		// Back above the bound, but not by hysteresis yet
+		{6.5, HealthWarn},
+		{7.4, HealthWarn},
+		{7.5, HealthOK},
+		// Recovered, so the bound alone counts again
+		{6.2, HealthOK},
+	}
+	for i, step := range steps {
+		state := ruleTestState(start.Add(time.Second*time.Duration(i)), step.snr, 20)
+		rules.Judge(state)
+		if state.Health != step.health {
+			t.Errorf("down_snr = %v: Health = %s, want %s", step.snr, state.Health, step.health)
+		}
+	}
+}
+
+func TestRulesOrder(t *testing.T) {
+	rules := NewRules([]*RuleConfig{
+		{Name: "loss", Metric: "link_loss", Max: bound(30), Level: string(HealthWarn)},
+		{Name: "snr", Metric: "down_snr", Min: bound(6), Level: string(HealthError)},
+		{Name: "low snr", Metric: "down_snr", Min: bound(9), Level: string(HealthWarn)},
+	})
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	tests := []struct {
+		snr, loss float64
+		health    Health
+		reason    string
+	}{
+		{12, 20, HealthOK, ""},
+		{8, 20, HealthWarn, "low snr"},
+		// The worst level wins, reasons are in the order of the rules
+		{5, 20, HealthError, "snr+low snr"},
+		{5, 35, HealthError, "loss+snr+low snr"},
+		{8, 35, HealthWarn, "loss+low snr"},
+	}
+	for i, test := range tests {
+		state := ruleTestState(start.Add(time.Second*time.Duration(i)), test.snr, test.loss)
+		rules.Judge(state)
+		if state.Health != test.health || state.Reason != test.reason {
+			t.Errorf("down_snr = %v, link_loss = %v: judged %s for %q, want %s for %q",
+				test.snr, test.loss, state.Health, state.Reason, test.health, test.reason)
+		}
+	}
+}
+
+func TestRulesStartOverWhenDisconnected(t *testing.T) {
+	rules := NewRules([]*RuleConfig{
+		{Name: "snr", Metric: "down_snr", Min: bound(6), For: time.Minute, Level: string(HealthWarn)},
+	})
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	rules.Judge(ruleTestState(start, 5, 20))
+
+	down := ruleTestState(start.Add(time.Second*30), 5, 20)
+	down.WAN = router.Disconnected
+	if rules.Judge(down); down.Health != HealthError || down.Reason != "" {
+		t.Errorf("disconnected: judged %s for %q, want %s by default", down.Health, down.Reason, HealthError)
+	}
+
+	// Out of bounds for over a minute, but only for 40s since the line came back
+	rules.Judge(ruleTestState(start.Add(time.Second*40), 5, 20))
+	state := ruleTestState(start.Add(time.Second*80), 5, 20)
+	if rules.Judge(state); state.Health != HealthOK {
+		t.Errorf("Health = %s, want %s until the rule held for a minute since reconnecting", state.Health, HealthOK)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zalando/go-keyring"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Password stores, see AuthConfig.PasswordStore
+const (
+	// storeKeyring is the secret store of the OS: Secret Service, Keychain or Credential Manager.
+	// Passwords fall back to storeFile where there is no keyring.
+	storeKeyring = "keyring"
+	// storeFile is a file of passwords beside config.ini, encrypted with a key in another file
+	storeFile = "file"
+)
+
+// keyringService is the service passwords are stored under in the keyring
+const keyringService = "otecstar"
+
+// errNoPassword is returned when a store has no password for an account
+var errNoPassword = errors.New("no password stored")
+
+// secretAccount names the password of a router in stores
+func secretAccount(auth *AuthConfig) string {
+	return auth.Username + "@" + auth.RouterIP
+}
+
+// loadPassword reads the password of account from store
+func loadPassword(store, account string) (string, error) {
+	switch store {
+	case storeKeyring:
+		password, err := keyring.Get(keyringService, account)
+		if err == nil {
+			return password, nil
+		}
+		if err != keyring.ErrNotFound {
+			logger.Debug().Err(err).Msg("Keyring unavailable, trying the password file")
+		}
+		return loadFilePassword(account)
+	case storeFile:
+		return loadFilePassword(account)
+	default:
+		return "", fmt.Errorf("unknown password store %q, should be keyring or file", store)
+	}
+}
+
+// savePassword writes the password of account to store, returning the store it ended up in
+func savePassword(store, account, password string) (string, error) {
+	switch store {
+	case storeKeyring:
+		err := keyring.Set(keyringService, account, password)
+		if err == nil {
+			return storeKeyring, nil
+		}
+		logger.Warn().Err(err).Msg("Keyring unavailable, falling back to the encrypted password file")
+		return storeFile, saveFilePassword(account, password)
+	case storeFile:
+		return storeFile, saveFilePassword(account, password)
+	default:
+		return "", fmt.Errorf("unknown password store %q, should be keyring or file", store)
+	}
+}
+
+// secretFilePaths are the encrypted passwords, and the key to them
+func secretFilePaths() (string, string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, "passwords.json"), filepath.Join(dir, "passwords.key"), nil
+}
+
+func loadFilePassword(account string) (string, error) {
+	path, keyPath, err := secretFilePaths()
+	if err != nil {
+		return "", err
+	}
+	passwords, err := readPasswordFile(path)
+	if err != nil {
+		return "", err
+	}
+	sealed, ok := passwords[account]
+	if !ok {
+		return "", fmt.Errorf("%w for %s, run `otecstar set-password`", errNoPassword, account)
+	}
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("password of %s is corrupted in %s", account, path)
+	}
+	password, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(account))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt password of %s, was %s replaced? %w", account, keyPath, err)
+	}
+	return string(password), nil
+}
+
+func saveFilePassword(account, password string) error {
+	path, keyPath, err := secretFilePaths()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	key, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return err
+		}
+		// O_EXCL so a key which encrypted passwords is never replaced
+		f, err := os.OpenFile(keyPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(key); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	passwords, err := readPasswordFile(path)
+	if err != nil && !errors.Is(err, errNoPassword) {
+		return err
+	}
+	if passwords == nil {
+		passwords = map[string]string{}
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	passwords[account] = base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(password), []byte(account)))
+
+	data, err := json.MarshalIndent(passwords, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readPasswordFile reads encrypted passwords by account
+func readPasswordFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w, run `otecstar set-password`", errNoPassword)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var passwords map[string]string
+	if err := json.Unmarshal(data, &passwords); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return passwords, nil
+}
+
+// newAEAD makes AES-GCM with key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("password key should be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
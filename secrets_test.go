@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// useConfigDir points the config file into a new temporary directory, where the password file store is
+func useConfigDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "otecstar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicit := configFlags.path
+	configFlags.path = filepath.Join(dir, "config.ini")
+	t.Cleanup(func() {
+		configFlags.path = explicit
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestFilePasswordRoundTrip(t *testing.T) {
+	dir := useConfigDir(t)
+	accounts := map[string]string{
+		"admin@192.168.123.1": "secret",
+		"admin@10.0.0.1":      "pässwörd with spaces",
+		"guest@10.0.0.1":      "",
+	}
+	for account, password := range accounts {
+		store, err := savePassword(storeFile, account, password)
+		if err != nil {
+			t.Fatalf("savePassword(%s) = %v", account, err)
+		}
+		if store != storeFile {
+			t.Errorf("savePassword(%s) saved to %s, want %s", account, store, storeFile)
+		}
+	}
+	// Saving again replaces the password of the account only
+	accounts["admin@10.0.0.1"] = "changed"
+	if _, err := savePassword(storeFile, "admin@10.0.0.1", "changed"); err != nil {
+		t.Fatalf("savePassword() = %v", err)
+	}
+
+	for account, want := range accounts {
+		password, err := loadPassword(storeFile, account)
+		if err != nil {
+			t.Errorf("loadPassword(%s) = %v", account, err)
+		} else if password != want {
+			t.Errorf("loadPassword(%s) = %q, want %q", account, password, want)
+		}
+	}
+	if _, err := loadPassword(storeFile, "nobody@10.0.0.1"); !errors.Is(err, errNoPassword) {
+		t.Errorf("loadPassword() of an unknown account = %v, want errNoPassword", err)
+	}
+
+	// Passwords are not in the clear
+	data, err := ioutil.ReadFile(filepath.Join(dir, "passwords.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), "changed") {
+		t.Errorf("passwords.json has passwords in the clear: %s", data)
+	}
+}
+
+func TestFilePasswordPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not permissions on Windows")
+	}
+	dir := useConfigDir(t)
+	if _, err := savePassword(storeFile, "admin@192.168.123.1", "secret"); err != nil {
+		t.Fatalf("savePassword() = %v", err)
+	}
+	for _, name := range []string{"passwords.json", "passwords.key"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s mode = %o, want 600", name, mode)
+		}
+	}
+}
+
+func TestFilePasswordNoStore(t *testing.T) {
+	useConfigDir(t)
+	if _, err := loadPassword(storeFile, "admin@192.168.123.1"); !errors.Is(err, errNoPassword) {
+		t.Errorf("loadPassword() without passwords.json = %v, want errNoPassword", err)
+	}
+	if _, err := loadPassword("vault", "admin@192.168.123.1"); err == nil {
+		t.Error("loadPassword() of an unknown store succeeded")
+	}
+	if _, err := savePassword("vault", "admin@192.168.123.1", "secret"); err == nil {
+		t.Error("savePassword() to an unknown store succeeded")
+	}
+}
+
+func TestFilePasswordMissingKey(t *testing.T) {
+	dir := useConfigDir(t)
+	if _, err := savePassword(storeFile, "admin@192.168.123.1", "secret"); err != nil {
+		t.Fatalf("savePassword() = %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "passwords.key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPassword(storeFile, "admin@192.168.123.1"); !os.IsNotExist(err) {
+		t.Errorf("loadPassword() without passwords.key = %v, want it not found", err)
+	}
+}
+
+func TestFilePasswordWrongKey(t *testing.T) {
+	dir := useConfigDir(t)
+	if _, err := savePassword(storeFile, "admin@192.168.123.1", "secret"); err != nil {
+		t.Fatalf("savePassword() = %v", err)
+	}
+	keyPath := filepath.Join(dir, "passwords.key")
+
+	if err := ioutil.WriteFile(keyPath, make([]byte, 32), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := loadPassword(storeFile, "admin@192.168.123.1")
+	if err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+		t.Errorf("loadPassword() with another key = %v, want a decryption failure", err)
+	}
+
+	if err := ioutil.WriteFile(keyPath, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPassword(storeFile, "admin@192.168.123.1"); err == nil {
+		t.Error("loadPassword() with a key of the wrong size succeeded")
+	}
+}
+
+func TestFilePasswordBoundToAccount(t *testing.T) {
+	dir := useConfigDir(t)
+	if _, err := savePassword(storeFile, "admin@192.168.123.1", "secret"); err != nil {
+		t.Fatalf("savePassword() = %v", err)
+	}
+	path := filepath.Join(dir, "passwords.json")
+	passwords, err := readPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A password moved to another account does not decrypt
+	passwords["admin@10.0.0.1"] = passwords["admin@192.168.123.1"]
+	data, err := json.Marshal(passwords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPassword(storeFile, "admin@10.0.0.1"); err == nil {
+		t.Error("loadPassword() decrypted the password of another account")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"golang.org/x/term"
+	"os"
+	"strings"
+)
+
+// runSetPassword stores the password of a router of config.ini in a password store
+func runSetPassword(args []string) error {
+	flags := flag.NewFlagSet("set-password", flag.ExitOnError)
+	addConfigFlags(flags)
+	name := flags.String("router", "", "name of the router, required when there are several")
+	store := flags.String("store", "", "keyring or file, defaults to password_store of config.ini, or keyring")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loadConfigFile()
+	if err != nil {
+		return err
+	}
+	if *name == "" && len(config.Routers) > 1 {
+		var names []string
+		for _, router := range config.Routers {
+			names = append(names, router.Name)
+		}
+		return fmt.Errorf("choose a router with --router: %s", strings.Join(names, ", "))
+	}
+	routerConfig, err := config.router(*name)
+	if err != nil {
+		return err
+	}
+	if *store == "" {
+		*store = routerConfig.PasswordStore
+	}
+	if *store == "" {
+		*store = storeKeyring
+	}
+	account := secretAccount(routerConfig.AuthConfig)
+
+	password, err := readPassword(fmt.Sprintf("Password of %s: ", account))
+	if err != nil {
+		return err
+	}
+	if password == "" {
+		return errors.New("empty password")
+	}
+	used, err := savePassword(*store, account, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Password of %s saved to %s.\n", account, used)
+	if routerConfig.PasswordStore != used {
+		fmt.Printf("Set `password_store = %s` in the [%s] section of config.ini, and remove `password`.\n", used, routerConfig.section)
+	}
+	return nil
+}
+
+// readPassword prompts for a password without echoing it, and asks again to confirm.
+// Without a terminal, it reads a line from stdin.
+func readPassword(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Print(prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Again: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if string(password) != string(again) {
+		return "", errors.New("passwords do not match")
+	}
+	return string(password), nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog"
+	"golang.org/x/term"
+	"gopkg.in/ini.v1"
+	"io"
+	"os"
+	"otecstar/router"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// setupFallbackIP is where OTECStar routers are found out of the box, tried after the default gateway
+const setupFallbackIP = "192.168.123.1"
+
+// runSetup finds the router, asks for its credentials, tries them, and writes a config file with them
+func runSetup(args []string) error {
+	flags := flag.NewFlagSet("setup", flag.ExitOnError)
+	flags.Var(configPathFlag{}, "config", "config file to write instead of the first of the search paths")
+	force := flags.Bool("force", false, "overwrite an existing config file without asking")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// Prompts are on stdout, only warnings are worth interleaving with them
+	setLogOutput(os.Stderr)
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	path, found, err := configPath()
+	if err != nil {
+		return err
+	}
+	p := prompter{in: bufio.NewReader(os.Stdin)}
+	if found && !*force {
+		overwrite, err := p.confirm(fmt.Sprintf("%s exists, overwrite it?", path), false)
+		if err != nil {
+			return err
+		}
+		if !overwrite {
+			fmt.Printf("Kept %s as it is.\n", path)
+			return nil
+		}
+	}
+
+	fmt.Println("Looking for the router...")
+	guess := findRouter()
+	if guess == "" {
+		fmt.Println("No OTECStar router found on this network, enter its address below.")
+		guess = setupFallbackIP
+	}
+
+	auth := AuthConfig{RouterIP: guess, Username: "admin"}
+	for {
+		if auth.RouterIP, err = p.ask("Router IP", auth.RouterIP); err != nil {
+			return err
+		}
+		if problem := checkHostPort(auth.RouterIP); problem != "" {
+			fmt.Printf("%s: %s.\n", auth.RouterIP, problem)
+			continue
+		}
+		if auth.Username, err = p.ask("Username", auth.Username); err != nil {
+			return err
+		}
+		if auth.Password, err = p.password("Password: "); err != nil {
+			return err
+		}
+		redactValues(auth.Password)
+
+		state, err := tryRouter(&auth)
+		if err == nil {
+			fmt.Printf("Logged in, WAN is %s and link is %s: %s.\n", state.WAN, state.Link, describeState(state))
+			break
+		}
+		fmt.Println(setupFailure(&auth, err))
+		again, err2 := p.confirm("Try again?", true)
+		if err2 != nil {
+			return err2
+		}
+		if !again {
+			return fmt.Errorf("router not set up: %w", err)
+		}
+	}
+
+	keep, err := p.confirm("Keep the password in a password store rather than in the config file?", true)
+	if err != nil {
+		return err
+	}
+	if keep {
+		// The file store is beside the config file, which may not exist yet
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if auth.PasswordStore, err = savePassword(storeKeyring, secretAccount(&auth), auth.Password); err != nil {
+			return err
+		}
+		fmt.Printf("Password saved to %s.\n", auth.PasswordStore)
+	}
+
+	if err := writeSetupConfig(path, &auth); err != nil {
+		return err
+	}
+	run := "otecstar"
+	if configFlags.path != "" {
+		run += " --config " + configFlags.path
+	}
+	fmt.Printf("Wrote %s, run `%s` to start monitoring.\n", path, run)
+	return nil
+}
+
+// findRouter returns the first address serving the login page of an OTECStar router: the default gateway,
+// or else setupFallbackIP. It's empty when neither does.
+func findRouter() string {
+	var candidates []string
+	if gateway, err := defaultGateway(); err != nil {
+		logger.Debug().Err(err).Msg("Default gateway unknown")
+	} else {
+		candidates = append(candidates, gateway.String())
+	}
+	if len(candidates) == 0 || candidates[0] != setupFallbackIP {
+		candidates = append(candidates, setupFallbackIP)
+	}
+
+	for _, ip := range candidates {
+		client := router.NewClient(ip, "", "")
+		client.SetTimeouts(time.Second*2, time.Second*3)
+		err := client.Probe(context.Background())
+		client.Close()
+		if err == nil {
+			fmt.Printf("Found the login page of OTECStar at %s.\n", ip)
+			return ip
+		}
+		logger.Debug().Err(err).Str("ip", ip).Msg("No router here")
+	}
+	return ""
+}
+
+// tryRouter logs in with auth and reads the WAN page once, as polling will
+func tryRouter(auth *AuthConfig) (*State, error) {
+	defaults := defaultConfig()
+	client := router.NewClient(auth.RouterIP, auth.Username, auth.Password)
+	client.SetTimeouts(defaults.ConnectTimeout, defaults.ReadTimeout)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), (defaults.ConnectTimeout+defaults.ReadTimeout)*3)
+	defer cancel()
+	if err := client.Probe(ctx); err != nil {
+		return nil, err
+	}
+	if err := client.Login(ctx); err != nil {
+		return nil, err
+	}
+	state := newState(client.Capture(ctx))
+	if state.Err != nil {
+		return nil, state.Err
+	}
+	return state, nil
+}
+
+// setupFailure explains why trying auth failed, by the kind of the failure
+func setupFailure(auth *AuthConfig, err error) string {
+	switch router.Classify(err) {
+	case router.FailureNetwork:
+		return fmt.Sprintf("Could not reach %s, is this computer on the network of the router? (%s)", auth.RouterIP, err)
+	case router.FailureAuth:
+		return fmt.Sprintf("%s refused the username or password.", auth.RouterIP)
+	case router.FailureFormat:
+		return fmt.Sprintf("%s does not look like an OTECStar router. (%s)", auth.RouterIP, err)
+	default:
+		return fmt.Sprintf("Failed to read %s: %s", auth.RouterIP, err)
+	}
+}
+
+// writeSetupConfig writes a config file for the router of auth to path, readable by the owner only.
+// It's validated before replacing anything at path.
+func writeSetupConfig(path string, auth *AuthConfig) error {
+	file := ini.Empty()
+	file.Section("").Comment = "; Written by `otecstar setup`, see config_sample.ini in the repository for every key"
+	section := file.Section("auth")
+	section.Comment = "; auth section stores authentication configs"
+	section.Key("router_ip").SetValue(auth.RouterIP)
+	section.Key("username").SetValue(auth.Username)
+	if auth.PasswordStore != "" {
+		section.Key("password_store").SetValue(auth.PasswordStore)
+	} else {
+		section.Key("password").SetValue(auth.Password)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Load it as every command will, which reads the password back from its store too
+	explicit := configFlags.path
+	configFlags.path = tmpPath
+	_, err = LoadConfig()
+	configFlags.path = explicit
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("written config is invalid: %w", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// prompter asks questions on stdout, and reads answers from in
+type prompter struct {
+	in *bufio.Reader
+}
+
+// ask asks for a value, which is def when the answer is empty
+func (p prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", question, def)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := p.line()
+	if err != nil {
+		return "", err
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// confirm asks a yes or no question, which is def when the answer is empty
+func (p prompter) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	for {
+		fmt.Printf("%s [%s]: ", question, hint)
+		answer, err := p.line()
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// password asks for a password without echoing it. It's tried right away, so it's not asked twice like
+// readPassword does. Without a terminal, it's read as a line.
+func (p prompter) password(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		fmt.Print(prompt)
+		password, err := p.line()
+		fmt.Println()
+		return password, err
+	}
+	fmt.Print(prompt)
+	password, err := term.ReadPassword(fd)
+	fmt.Println()
+	return string(password), err
+}
+
+// line reads a line without its line break, stdin running out before an answer is an error
+func (p prompter) line() (string, error) {
+	line, err := p.in.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", errors.New("setup cancelled, no more input")
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
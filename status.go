@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"otecstar/router"
+	"sync"
+	"text/tabwriter"
+	"text/template"
+	"time"
+)
+
+// Exit statuses of the status command, the first four follow Nagios plugin conventions
+const (
+	statusUp          exitStatus = 0 // Line connected and healthy
+	statusDegraded    exitStatus = 1 // Line connected, but with bad readings
+	statusDown        exitStatus = 2 // WAN or link disconnected
+	statusUnreachable exitStatus = 3 // Router could not be reached
+	statusAuthFailed  exitStatus = 4 // Router refused the credentials
+	statusFailed      exitStatus = 5 // Anything else, like a bad config or an unknown page format
+)
+
+// StatusReport is what the status command prints, it is also the data given to `--format` templates
+type StatusReport struct {
+	*State
+	// RouterIP is the router_ip of the router, State.Router is its name
+	RouterIP string
+	Health   Health
+}
+
+// runStatus logs in to every router, captures its state once and prints it. The exit status tells how the
+// worst line is.
+func runStatus(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	addConfigFlags(flags)
+	name := flags.String("router", "", "name of the router to check, defaults to all of them")
+	asJSON := flags.Bool("json", false, "print as JSON")
+	format := flags.String("format", "", "print with a Go template, like '{{.Health}} {{.DownSNR}}'")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var tpl *template.Template
+	if *format != "" {
+		var err error
+		if tpl, err = template.New("format").Parse(*format); err != nil {
+			logger.Error().Err(err).Msg("Invalid format")
+			return statusFailed
+		}
+	}
+
+	// Stdout is for the report, logs go elsewhere
+	setLogOutput(os.Stderr)
+	config, err := prepare()
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to load config")
+		return statusFailed
+	}
+
+	routers := config.Routers
+	if *name != "" {
+		routerConfig, err := config.router(*name)
+		if err != nil {
+			logger.Error().Err(err).Msg("Unknown router")
+			return statusFailed
+		}
+		routers = []*RouterConfig{routerConfig}
+	}
+
+	// Routers are captured at once, so checking many is as slow as the slowest
+	reports := make([]*StatusReport, len(routers))
+	var wg sync.WaitGroup
+	for i, routerConfig := range routers {
+		wg.Add(1)
+		go func(i int, routerConfig *RouterConfig) {
+			defer wg.Done()
+			reports[i] = captureStatus(config, routerConfig)
+		}(i, routerConfig)
+	}
+	wg.Wait()
+
+	worst := statusUp
+	var states []json.RawMessage
+	for i, report := range reports {
+		switch {
+		case *asJSON:
+			data, err := marshalState(report.State)
+			if err != nil {
+				return err
+			}
+			states = append(states, data)
+		case tpl != nil:
+			if err := tpl.Execute(os.Stdout, report); err != nil {
+				logger.Error().Err(err).Msg("Failed to print with format")
+				return statusFailed
+			}
+			fmt.Println()
+		default:
+			if i > 0 {
+				fmt.Println()
+			}
+			if err := printStatus(report); err != nil {
+				return err
+			}
+		}
+		if status := report.exitStatus(); status > worst {
+			worst = status
+		}
+	}
+	if *asJSON {
+		// A single router is an object, as it was before there could be several
+		data := []byte(states[0])
+		if len(states) > 1 {
+			var err error
+			if data, err = json.Marshal(states); err != nil {
+				return err
+			}
+		}
+		fmt.Println(string(data))
+	}
+	return worst
+}
+
+// captureStatus logs in to a router and captures its state once
+func captureStatus(config *Config, routerConfig *RouterConfig) *StatusReport {
+	client := router.NewClient(routerConfig.RouterIP, routerConfig.Username, routerConfig.Password)
+	client.SetTimeouts(config.ConnectTimeout, config.ReadTimeout)
+	defer client.Close()
+	state := newState(client.Capture(context.Background()))
+	state.Router = routerConfig.Name
+	// Rules with a duration can't fire from a single state
+	NewRules(routerConfig.Rules).Judge(state)
+	return &StatusReport{
+		State:    state,
+		RouterIP: routerConfig.RouterIP,
+		Health:   Evaluate(state),
+	}
+}
+
+// exitStatus classifies the report for scripts
+func (r *StatusReport) exitStatus() exitStatus {
+	switch {
+	case r.Err == nil && r.Health == HealthOK:
+		return statusUp
+	case r.Err == nil && r.Health == HealthWarn:
+		return statusDegraded
+	case r.Err == nil:
+		return statusDown
+	case router.Classify(r.Err) == router.FailureAuth:
+		return statusAuthFailed
+	case router.Classify(r.Err) == router.FailureNetwork:
+		return statusUnreachable
+	default:
+		return statusFailed
+	}
+}
+
+// printStatus prints report as a table with the same fields as the tray menu
+func printStatus(r *StatusReport) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if r.Router != r.RouterIP {
+		fmt.Fprintf(w, "Name\t%s\n", r.Router)
+	}
+	fmt.Fprintf(w, "Router\t%s\n", r.RouterIP)
+	fmt.Fprintf(w, "Health\t%s, %s\n", r.Health, describeState(r.State))
+	if r.Err != nil {
+		fmt.Fprintf(w, "Error\t%s\n", r.Err)
+	} else {
+		fmt.Fprintf(w, "WAN\t%s\n", r.WAN)
+		fmt.Fprintf(w, "Link\t%s\n", r.Link)
+		fmt.Fprintf(w, "Attenuation\t%s dB\n", formatNumber(r.LinkLoss))
+		fmt.Fprintf(w, "Upstream rate\t%s Mbps\n", formatNumber(r.UpRate))
+		fmt.Fprintf(w, "Upstream SNR\t%s dB\n", formatNumber(r.UpSNR))
+		fmt.Fprintf(w, "Downstream rate\t%s Mbps\n", formatNumber(r.DownRate))
+		fmt.Fprintf(w, "Downstream SNR\t%s dB\n", formatNumber(r.DownSNR))
+	}
+	fmt.Fprintf(w, "Captured at\t%s (in %s)\n", r.CapturedAt.Local().Format("2006-01-02 15:04:05"), r.RoundTrip.Round(time.Millisecond))
+	return w.Flush()
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// streamBuffer is how many events a client may lag behind, older ones are dropped beyond that
+	streamBuffer = 64
+	// streamHeartbeat is how often idle SSE connections get a comment, to keep proxies from closing them
+	streamHeartbeat = time.Second * 15
+)
+
+// streamEvent is an event sent to stream clients
+type streamEvent struct {
+	Type string          `json:"type"` // state or transition
+	Data json.RawMessage `json:"data"`
+}
+
+// streamClient is a subscriber of Stream with its own buffer, so a slow one can not hold up others
+type streamClient struct {
+	events  chan *streamEvent
+	dropped int
+}
+
+// Stream pushes every captured state and every health transition of every router to subscribers,
+// over Server-Sent Events and WebSocket. It never blocks the Pollers.
+type Stream struct {
+	mu       sync.Mutex
+	clients  map[*streamClient]struct{}
+	detector *RouterTransitions
+	latest   map[string]*streamEvent // By router
+	order    []string                // Routers in latest, in the order they were first seen
+	closeCh  chan struct{}
+	closed   bool
+}
+
+// NewStream constructs a Stream without subscribers
+func NewStream() *Stream {
+	return &Stream{
+		clients:  map[*streamClient]struct{}{},
+		detector: NewRouterTransitions(0),
+		latest:   map[string]*streamEvent{},
+		closeCh:  make(chan struct{}),
+	}
+}
+
+// Close ends all streams, so they don't hold up shutting the HTTP listener down
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.closeCh)
+	}
+}
+
+// Consume pushes a captured state to subscribers, it's meant to be a Poller consumer
+func (s *Stream) Consume(state *State) {
+	data, err := marshalState(state)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed to encode state for stream")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.latest[state.Router]; !ok {
+		s.order = append(s.order, state.Router)
+	}
+	s.latest[state.Router] = &streamEvent{Type: "state", Data: data}
+	s.broadcast(s.latest[state.Router])
+	if t := s.detector.Next(state); t != nil {
+		data, _ := json.Marshal(map[string]interface{}{
+			"router":           state.Router,
+			"from":             t.From,
+			"to":               t.To,
+			"at":               t.At,
+			"downtime_seconds": t.Downtime.Seconds(),
+			"cause":            t.Cause,
+			"message":          transitionMessage(t),
+		})
+		s.broadcast(&streamEvent{Type: "transition", Data: data})
+	}
+}
+
+// broadcast queues event to every client, dropping the oldest queued event of clients which lag behind
+func (s *Stream) broadcast(event *streamEvent) {
+	for client := range s.clients {
+		for {
+			select {
+			case client.events <- event:
+			default:
+				select {
+				case <-client.events:
+					client.dropped++
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// subscribe adds a client, which gets the latest state of every router right away
+func (s *Stream) subscribe() *streamClient {
+	client := &streamClient{events: make(chan *streamEvent, streamBuffer)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[client] = struct{}{}
+	for _, name := range s.order {
+		select {
+		case client.events <- s.latest[name]:
+		default:
+		}
+	}
+	return client
+}
+
+func (s *Stream) unsubscribe(client *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, client)
+	if client.dropped > 0 {
+		logger.Debug().Int("dropped", client.dropped).Msg("Stream client lagged behind")
+	}
+}
+
+// Register adds the stream routes to mux
+func (s *Stream) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/api/v1/stream", s.serveSSE)
+	mux.Handle("/api/v1/ws", websocket.Server{Handler: s.serveWebSocket, Handshake: checkOrigin})
+}
+
+// checkOrigin refuses WebSocket connections from pages of other sites, which browsers let through otherwise.
+// Clients other than browsers send no Origin, they are let in like they are on the other routes.
+func checkOrigin(config *websocket.Config, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != req.Host {
+		return fmt.Errorf("origin %s is not %s", origin, req.Host)
+	}
+	config.Origin = u
+	return nil
+}
+
+// serveSSE streams events as Server-Sent Events, named by their type
+func (s *Stream) serveSSE(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client := s.subscribe()
+	defer s.unsubscribe(client)
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event := <-client.events:
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, event.Data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// serveWebSocket streams events as JSON text messages like {"type": "state", "data": {...}}
+func (s *Stream) serveWebSocket(conn *websocket.Conn) {
+	defer conn.Close()
+	client := s.subscribe()
+	defer s.unsubscribe(client)
+
+	// We don't expect anything from the other side, reading only tells when it's gone
+	closed := make(chan struct{})
+	go func() {
+		var discard []byte
+		for websocket.Message.Receive(conn, &discard) == nil {
+		}
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-closed:
+			return
+		case event := <-client.events:
+			if err := websocket.JSON.Send(conn, event); err != nil {
+				return
+			}
+		}
+	}
+}
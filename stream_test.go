@@ -0,0 +1,45 @@
+package main
+
+import (
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamWebSocketOrigin(t *testing.T) {
+	stream := NewStream()
+	defer stream.Close()
+	mux := http.NewServeMux()
+	stream.Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/ws"
+
+	if conn, err := websocket.Dial(wsURL, "", "http://evil.example"); err == nil {
+		conn.Close()
+		t.Error("a page of another site connected")
+	}
+
+	// The dashboard is served from the same host
+	conn, err := websocket.Dial(wsURL, "", server.URL)
+	if err != nil {
+		t.Fatalf("Dial() from the dashboard = %v", err)
+	}
+	defer conn.Close()
+	waitFor(t, "the client to subscribe", func() bool {
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		return len(stream.clients) == 1
+	})
+	stream.Consume(testState(HealthOK, time.Now()))
+	var event streamEvent
+	if err := websocket.JSON.Receive(conn, &event); err != nil {
+		t.Fatalf("Receive() = %v", err)
+	}
+	if event.Type != "state" {
+		t.Errorf("event type = %s, want state", event.Type)
+	}
+}
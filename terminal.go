@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// terminalEmulators are tried in order on desktops other than Windows and macOS, with the flag before
+// the command to run
+var terminalEmulators = [][2]string{
+	{"x-terminal-emulator", "-e"},
+	{"gnome-terminal", "--"},
+	{"konsole", "-e"},
+	{"xfce4-terminal", "-x"},
+	{"xterm", "-e"},
+}
+
+// openTerminal runs a command in a new terminal window of the desktop, so it can ask questions
+func openTerminal(command ...string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		// The empty argument is the title of the window, start takes a first quoted argument as one
+		cmd = exec.Command("cmd", append([]string{"/c", "start", ""}, command...)...)
+	case "darwin":
+		quoted := make([]string, len(command))
+		for i, arg := range command {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		script := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(strings.Join(quoted, " "))
+		cmd = exec.Command("osascript",
+			"-e", fmt.Sprintf(`tell application "Terminal" to do script "%s"`, script),
+			"-e", `tell application "Terminal" to activate`)
+	default:
+		for _, emulator := range terminalEmulators {
+			if path, err := exec.LookPath(emulator[0]); err == nil {
+				cmd = exec.Command(path, append([]string{emulator[1]}, command...)...)
+				break
+			}
+		}
+		if cmd == nil {
+			return errors.New("no terminal emulator found")
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"time"
+)
+
+// Transition is a change of Health, reported once the new health lasted for the debounce duration
+type Transition struct {
+	From Health
+	To   Health
+	// At is when To was first seen
+	At time.Time
+	// Downtime is how long the network was down, only set when From is HealthError
+	Downtime time.Duration
+	// Cause is what failed when To is HealthError, see outageCause
+	Cause string
+	// State is the state which made the transition reported
+	State *State
+}
+
+// TransitionDetector turns a sequence of states into Transitions. It is not safe for concurrent use.
+type TransitionDetector struct {
+	debounce time.Duration
+
+	reported     Health
+	pending      Health
+	pendingSince time.Time
+	pendingCause string
+	downSince    time.Time
+}
+
+// NewTransitionDetector constructs a TransitionDetector, assuming the network was OK before the first state
+func NewTransitionDetector(debounce time.Duration) *TransitionDetector {
+	return &TransitionDetector{
+		debounce: debounce,
+		reported: HealthOK,
+	}
+}
+
+// Next consumes a state, returning the Transition it completes, or nil
+func (d *TransitionDetector) Next(state *State) *Transition {
+	health := Evaluate(state)
+	if health == d.reported {
+		d.pending = ""
+		return nil
+	}
+	if health != d.pending {
+		d.pending, d.pendingSince = health, state.CapturedAt
+		d.pendingCause = outageCause(state)
+	}
+	if state.CapturedAt.Sub(d.pendingSince) < d.debounce {
+		return nil
+	}
+
+	t := Transition{
+		From:  d.reported,
+		To:    health,
+		At:    d.pendingSince,
+		State: state,
+	}
+	switch {
+	case health == HealthError:
+		d.downSince = d.pendingSince
+		t.Cause = d.pendingCause
+	case d.reported == HealthError:
+		t.Downtime = d.pendingSince.Sub(d.downSince)
+	}
+	d.reported, d.pending = health, ""
+	return &t
+}
+
+// RouterTransitions turns the states of every router into Transitions, each router on its own.
+// It is not safe for concurrent use.
+type RouterTransitions struct {
+	debounce  time.Duration
+	detectors map[string]*TransitionDetector // By router
+}
+
+// NewRouterTransitions constructs RouterTransitions, debouncing like NewTransitionDetector
+func NewRouterTransitions(debounce time.Duration) *RouterTransitions {
+	return &RouterTransitions{
+		debounce:  debounce,
+		detectors: map[string]*TransitionDetector{},
+	}
+}
+
+// SetDebounce changes the debounce duration, pending transitions included
+func (r *RouterTransitions) SetDebounce(debounce time.Duration) {
+	r.debounce = debounce
+	for _, detector := range r.detectors {
+		detector.debounce = debounce
+	}
+}
+
+// Next consumes a state, returning the Transition of its router it completes, or nil
+func (r *RouterTransitions) Next(state *State) *Transition {
+	detector := r.detectors[state.Router]
+	if detector == nil {
+		detector = NewTransitionDetector(r.debounce)
+		r.detectors[state.Router] = detector
+	}
+	return detector.Next(state)
+}
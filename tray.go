@@ -0,0 +1,107 @@
+//go:build !notray
+// +build !notray
+
+package main
+
+import (
+	"errors"
+	"github.com/getlantern/systray"
+	"os"
+	"otecstar/icons"
+	"time"
+)
+
+// reloader of the tray app, its outputs are closed on exit
+var reloader *Reloader
+
+// runTray runs the system tray app until it quits
+func runTray() {
+	systray.Run(onReady, onExit)
+}
+
+func onReady() {
+	config, err := prepare()
+	if errors.Is(err, errNoConfig) {
+		if config = awaitSetup(); config == nil {
+			return
+		}
+	} else if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load config file")
+	}
+
+	pollers := NewPollers(config)
+	if reloader, err = NewReloader(config, pollers); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to start outputs")
+	}
+	for _, poller := range pollers {
+		poller.OnState(reloader.Consume)
+	}
+	_ = NewOTECStarApp(pollers, reloader)
+	for _, poller := range pollers {
+		go poller.Run()
+	}
+	if err := reloader.Watch(); err != nil {
+		logger.Warn().Err(err).Msg("Config changes need a reload from the menu to be applied")
+	}
+	logger.Info().Msg("Ready")
+}
+
+// awaitSetup offers to run `otecstar setup` in a terminal, and waits until it wrote a config file. The
+// config is nil when the app quits instead.
+func awaitSetup() *Config {
+	logger.Warn().Msg("No config file found, waiting for setup")
+	systray.SetTemplateIcon(icons.WARN_TPL, icons.WARN)
+	systray.SetTooltip("OTECStar: not set up yet")
+	setup := systray.AddMenuItem("Setup...", "Write a config file with `otecstar setup`")
+	quit := systray.AddMenuItem("Quit", "")
+
+	command := []string{"setup"}
+	if configFlags.path != "" {
+		command = append(command, "--config", configFlags.path)
+	}
+	if exe, err := os.Executable(); err == nil {
+		command = append([]string{exe}, command...)
+	} else {
+		command = append([]string{"otecstar"}, command...)
+	}
+
+	ticker := time.NewTicker(time.Second * 2)
+	defer ticker.Stop()
+	var lastErr string
+	for {
+		select {
+		case <-setup.ClickedCh:
+			if err := openTerminal(command...); err != nil {
+				logger.Error().Err(err).Msg("Failed to open a terminal, run `otecstar setup` instead")
+				systray.SetTooltip("OTECStar: failed to open a terminal, run `otecstar setup`")
+			}
+		case <-quit.ClickedCh:
+			systray.Quit()
+			return nil
+		case <-ticker.C:
+			config, err := prepare()
+			if errors.Is(err, errNoConfig) {
+				continue
+			}
+			if err != nil {
+				// Setup writes valid files only, this one is edited by hand and may not be complete yet
+				if err.Error() != lastErr {
+					lastErr = err.Error()
+					logger.Warn().Err(err).Msg("Config file is invalid, waiting for it to be fixed")
+					systray.SetTooltip("OTECStar: invalid config, " + lastErr)
+				}
+				continue
+			}
+			setup.Hide()
+			quit.Hide()
+			return config
+		}
+	}
+}
+
+func onExit() {
+	if reloader != nil {
+		reloader.Close()
+	}
+	logger.Info().Msg("Quit")
+}
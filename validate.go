@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/ini.v1"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bounds of interval
+const (
+	minInterval = time.Second
+	maxInterval = time.Hour
+)
+
+// maxRetryAttempts bounds retry.attempts, more tries within a poll only hold the next one up
+const maxRetryAttempts = 10
+
+// positiveDurations are the duration keys which can't be 0, the others can. None can be negative.
+var positiveDurations = []string{"interval", "connect_timeout", "read_timeout"}
+
+// logLevels are the valid values of log_level
+var logLevels = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}
+
+// hostnamePattern matches host names like router.lan
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.?$`)
+
+// ConfigError lists every problem found in the config, so that all of them can be fixed at once
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// knownConfigKeys are the keys of plain sections by section name, and of named sections like
+// `[rule "name"]` by kind
+func knownConfigKeys() (sections, named map[string][]configKey) {
+	defaults := defaultConfig()
+	sections = map[string][]configKey{}
+	for _, key := range configKeys(&defaults) {
+		sections[key.Section] = append(sections[key.Section], key)
+	}
+	named = map[string][]configKey{
+		"webhook": appendConfigKeys(nil, "", reflect.ValueOf(&WebhookConfig{}).Elem()),
+		"rule": append(appendConfigKeys(nil, "", reflect.ValueOf(&RuleConfig{}).Elem()),
+			// Checked by loadRule
+			configKey{Name: "min"}, configKey{Name: "max"}),
+		"router": append(appendConfigKeys(nil, "", reflect.ValueOf(&AuthConfig{}).Elem()),
+			configKey{Name: "interval", Type: durationType}),
+	}
+	return
+}
+
+// checkConfigFile reports unknown sections and keys of file, and values which don't parse as their key
+// should. Keys with such values are deleted from file, so they are left at their defaults.
+func checkConfigFile(file *ini.File, c *Config) (problems []string) {
+	sections, named := knownConfigKeys()
+	var sectionNames []string
+	for name := range sections {
+		if name != "" {
+			sectionNames = append(sectionNames, name)
+		}
+	}
+	sort.Strings(sectionNames)
+
+	for _, section := range file.Sections() {
+		name := section.Name()
+		if name == ini.DefaultSection {
+			name = ""
+		}
+		known, ok := sections[name]
+		if !ok {
+			for kind, keys := range named {
+				if _, ok = namedSection(name, kind); ok {
+					known = keys
+					break
+				}
+			}
+		}
+		if !ok {
+			candidates := sectionNames
+			// Like `[webhok "name"]`, suggest kinds of named sections with the same name
+			if i := strings.Index(name, ` "`); i > 0 {
+				candidates = nil
+				for kind := range named {
+					candidates = append(candidates, kind+name[i:])
+				}
+				sort.Strings(candidates)
+			}
+			problems = append(problems, fmt.Sprintf("[%s]: unknown section%s", name, didYouMean(name, candidates)))
+			continue
+		}
+
+		for _, key := range section.Keys() {
+			id := configKey{Section: name, Name: key.Name()}
+			var match *configKey
+			for i := range known {
+				if known[i].Name == key.Name() {
+					match = &known[i]
+				}
+			}
+			if match == nil {
+				problems = append(problems, fmt.Sprintf("%s: unknown key%s", id, suggestKey(id, known, sections)))
+				continue
+			}
+			if problem := checkConfigValue(key, match.Type); problem != "" {
+				problems = append(problems, c.problem(id.String(), key.String(), problem))
+				section.DeleteKey(key.Name())
+			}
+		}
+	}
+	return
+}
+
+// suggestKey suggests a known key for an unknown one, which may be in another section
+func suggestKey(key configKey, known []configKey, sections map[string][]configKey) string {
+	var names []string
+	for _, k := range known {
+		names = append(names, k.Name)
+	}
+	if suggestion := didYouMean(key.Name, names); suggestion != "" {
+		return suggestion
+	}
+	var sectionNames []string
+	for section := range sections {
+		sectionNames = append(sectionNames, section)
+	}
+	sort.Strings(sectionNames)
+	for _, section := range sectionNames {
+		for _, k := range sections[section] {
+			if k.Name == key.Name && section != key.Section {
+				if section == "" {
+					return ", it belongs before any section"
+				}
+				return fmt.Sprintf(", it belongs in [%s]", section)
+			}
+		}
+	}
+	return ""
+}
+
+// checkEnv reports environment variables which look like they override keys, but don't match any
+func checkEnv(keys []configKey) (problems []string) {
+	names := []string{configEnvPrefix + "CONFIG"}
+	for _, key := range keys {
+		names = append(names, key.Env())
+	}
+	for _, env := range os.Environ() {
+		name := strings.SplitN(env, "=", 2)[0]
+		if !strings.HasPrefix(name, configEnvPrefix) || containsString(names, name) {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s: unknown environment variable%s", name, didYouMean(name, names)))
+	}
+	return
+}
+
+// checkConfigValue tells what's wrong with the value of a key mapping to a field of type t.
+// Empty values are fine, they leave the default.
+func checkConfigValue(key *ini.Key, t reflect.Type) string {
+	if t == nil || key.String() == "" {
+		return ""
+	}
+	if t == durationType {
+		d, err := time.ParseDuration(key.String())
+		switch {
+		case err != nil:
+			return "should be a duration like 30s, 5m or 1h30m"
+		case d < 0:
+			return "should not be negative"
+		case d == 0 && containsString(positiveDurations, key.Name()):
+			return "should be positive"
+		}
+		return ""
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		if _, err := key.Bool(); err != nil {
+			return "should be true or false"
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _, err := key.Int64(); err != nil {
+			return "should be a whole number"
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if _, err := key.Uint64(); err != nil {
+			return "should be a whole number, not negative"
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, err := key.Float64(); err != nil {
+			return "should be a number"
+		}
+	}
+	return ""
+}
+
+// problem describes a problem with the value of key, along with where the value came from unless it's the file
+// or unknown, like values inherited by named sections
+func (c *Config) problem(key string, value interface{}, problem string) string {
+	line := fmt.Sprintf("%s = %v", key, value)
+	if source, ok := c.sources[key]; ok && source != c.file {
+		line += " (" + source + ")"
+	}
+	return line + ": " + problem
+}
+
+// checkConfig reports values of c which parsed fine, but make no sense
+func checkConfig(c *Config) (problems []string) {
+	problem := func(key string, value interface{}, problem string) {
+		problems = append(problems, c.problem(key, value, problem))
+	}
+
+	if !containsString(logLevels, c.LogLevel) {
+		problem("log_level", c.LogLevel, "should be one of "+strings.Join(logLevels, ", "))
+	}
+	if c.Interval < minInterval || c.Interval > maxInterval {
+		problem("interval", c.Interval, fmt.Sprintf("should be between %s and %s", minInterval, maxInterval))
+	}
+	if len(c.Routers) == 1 && c.Routers[0].section == "auth" {
+		problems = append(problems, checkRouter(c, c.Routers[0])...)
+	} else {
+		if c.RouterIP != "" {
+			problem("auth.router_ip", c.RouterIP, `unused along with [router "name"] sections, move it into one of them`)
+		}
+		var names []string
+		for _, router := range c.Routers {
+			problems = append(problems, checkRouter(c, router)...)
+			names = append(names, router.Name)
+		}
+		for _, rule := range c.Rules {
+			if rule.Router != "" && !containsString(names, rule.Router) {
+				problem(fmt.Sprintf("rule %q.router", rule.Name), rule.Router, "no such router"+didYouMean(rule.Router, names))
+			}
+		}
+	}
+	if c.Retry.Attempts < 1 || c.Retry.Attempts > maxRetryAttempts {
+		problem("retry.attempts", c.Retry.Attempts, fmt.Sprintf("should be between 1 and %d", maxRetryAttempts))
+	}
+	if c.Retry.BreakAfter < 0 {
+		problem("retry.break_after", c.Retry.BreakAfter, "should not be negative, 0 never pauses")
+	}
+	if c.MQTT.QoS > 2 {
+		problem("mqtt.qos", c.MQTT.QoS, "should be 0, 1 or 2")
+	}
+	if c.MQTT.Broker != "" {
+		// Names differing only in characters which are not topic safe would publish to the same topics
+		byNode := map[string]string{}
+		for _, router := range c.Routers {
+			node := topicSafe(router.Name)
+			if other, ok := byNode[node]; ok {
+				problem("mqtt.broker", c.MQTT.Broker, fmt.Sprintf("routers %q and %q would share the topic %s/%s, rename one of them",
+					other, router.Name, c.MQTT.TopicPrefix, node))
+			}
+			byNode[node] = router.Name
+		}
+	}
+	return
+}
+
+// checkRouter reports values of a router which make no sense, named after the section it came from
+func checkRouter(c *Config, router *RouterConfig) (problems []string) {
+	problem := func(key string, value interface{}, problem string) {
+		problems = append(problems, c.problem(router.section+"."+key, value, problem))
+	}
+
+	if router.RouterIP == "" {
+		problem("router_ip", `""`, "required, the IP of your OTECStar device like 192.168.123.1")
+	} else if p := checkHostPort(router.RouterIP); p != "" {
+		problem("router_ip", router.RouterIP, p)
+	}
+	if router.PasswordStore != "" {
+		if router.PasswordStore != storeKeyring && router.PasswordStore != storeFile {
+			problem("password_store", router.PasswordStore, "should be keyring or file")
+		}
+		if router.Password != "" {
+			problem("password_store", router.PasswordStore, "password is set too, remove it")
+		}
+	}
+	// The global interval is checked on its own
+	if router.section != "auth" && router.Interval != c.Interval &&
+		(router.Interval < minInterval || router.Interval > maxInterval) {
+		problem("interval", router.Interval, fmt.Sprintf("should be between %s and %s", minInterval, maxInterval))
+	}
+	return
+}
+
+// checkHostPort tells what's wrong with a host name or IP, which may have a port
+func checkHostPort(s string) string {
+	const usage = "should be a host name or IP, with an optional port like 192.168.123.1:8080"
+	if strings.Contains(s, "/") {
+		return usage + ", without http:// or a path"
+	}
+	host := s
+	if h, port, err := net.SplitHostPort(s); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "port should be between 1 and 65535"
+		}
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	if strings.Trim(host, "0123456789.") == "" {
+		return "not a valid IP"
+	}
+	if !hostnamePattern.MatchString(host) {
+		return usage
+	}
+	return ""
+}
+
+// didYouMean suggests the candidate closest to name, when it's close enough to be a typo
+func didYouMean(name string, candidates []string) string {
+	best, bestDistance := "", len(name)/3
+	if bestDistance < 2 {
+		bestDistance = 2
+	}
+	for _, candidate := range candidates {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(candidate)); d <= bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current := row[j]
+			row[j] = minInt(minInt(row[j]+1, row[j-1]+1), prev+cost)
+			prev = current
+		}
+	}
+	return row[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
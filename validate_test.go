@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadTestConfig loads a config file of given content, from a new temporary directory
+func loadTestConfig(t *testing.T, content string) (Config, error) {
+	dir := useConfigDir(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.ini"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfigFile()
+}
+
+func TestConfigDurations(t *testing.T) {
+	const auth = "[auth]\nrouter_ip = 192.168.123.1\n"
+	tests := []struct {
+		name    string
+		content string
+		// problem is what the only problem should say, there should be none when empty
+		problem string
+		// got reads the duration under test from the config when there is no problem
+		got  func(c *Config) time.Duration
+		want time.Duration
+	}{
+		{
+			name:    "interval",
+			content: "interval = 5s\n" + auth,
+			got:     func(c *Config) time.Duration { return c.Routers[0].Interval },
+			want:    time.Second * 5,
+		},
+		{
+			name:    "empty interval",
+			content: "interval =\n" + auth,
+			got:     func(c *Config) time.Duration { return c.Interval },
+			want:    time.Second,
+		},
+		{
+			name:    "negative interval",
+			content: "interval = -5s\n" + auth,
+			problem: "interval = -5s: should not be negative",
+		},
+		{
+			name:    "zero interval",
+			content: "interval = 0s\n" + auth,
+			problem: "interval = 0s: should be positive",
+		},
+		{
+			name:    "long interval",
+			content: "interval = 2h\n" + auth,
+			problem: "interval = 2h0m0s: should be between 1s and 1h0m0s",
+		},
+		{
+			name:    "invalid interval",
+			content: "interval = often\n" + auth,
+			problem: "interval = often: should be a duration like 30s, 5m or 1h30m",
+		},
+		{
+			name:    "zero connect_timeout",
+			content: "connect_timeout = 0s\n" + auth,
+			problem: "connect_timeout = 0s: should be positive",
+		},
+		{
+			name:    "negative read_timeout",
+			content: "read_timeout = -1s\n" + auth,
+			problem: "read_timeout = -1s: should not be negative",
+		},
+		{
+			name:    "zero debounce",
+			content: auth + "[notify]\ndebounce = 0s\n",
+			got:     func(c *Config) time.Duration { return c.Notify.Debounce },
+			want:    0,
+		},
+		{
+			name:    "negative debounce",
+			content: auth + "[notify]\ndebounce = -30s\n",
+			problem: "notify.debounce = -30s: should not be negative",
+		},
+		{
+			name:    "zero max_backoff",
+			content: auth + "[retry]\nmax_backoff = 0\n",
+			got:     func(c *Config) time.Duration { return c.Retry.MaxBackoff },
+			want:    0,
+		},
+		{
+			name:    "zero retention",
+			content: auth + "[history]\nretention = 0s\n",
+			got:     func(c *Config) time.Duration { return c.History.Retention },
+			want:    0,
+		},
+		{
+			name:    "zero webhook debounce",
+			content: auth + "[webhook \"team\"]\nurl = http://127.0.0.1/hook\ndebounce = 0s\n",
+			got:     func(c *Config) time.Duration { return c.Webhooks[0].Debounce },
+			want:    0,
+		},
+		{
+			name:    "negative webhook max_backoff",
+			content: auth + "[webhook \"team\"]\nurl = http://127.0.0.1/hook\nmax_backoff = -1m\n",
+			problem: "webhook \"team\".max_backoff = -1m: should not be negative",
+		},
+		{
+			name:    "negative rule for",
+			content: auth + "[rule \"snr\"]\nmetric = down_snr\nmin = 6\nfor = -2m\n",
+			problem: "rule \"snr\".for = -2m: should not be negative",
+		},
+		{
+			name:    "router interval",
+			content: "interval = 5s\n[router \"office\"]\nrouter_ip = 192.168.123.1\ninterval = 10s\n",
+			got:     func(c *Config) time.Duration { return c.Routers[0].Interval },
+			want:    time.Second * 10,
+		},
+		{
+			name:    "zero router interval",
+			content: "[router \"office\"]\nrouter_ip = 192.168.123.1\ninterval = 0s\n",
+			problem: "router \"office\".interval = 0s: should be positive",
+		},
+		{
+			name:    "negative router interval",
+			content: "[router \"office\"]\nrouter_ip = 192.168.123.1\ninterval = -1s\n",
+			problem: "router \"office\".interval = -1s: should not be negative",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := loadTestConfig(t, test.content)
+			if test.problem == "" {
+				if err != nil {
+					t.Fatalf("loadConfigFile() = %v", err)
+				}
+				if got := test.got(&c); got != test.want {
+					t.Errorf("duration = %s, want %s", got, test.want)
+				}
+				return
+			}
+			var invalid *ConfigError
+			if !errors.As(err, &invalid) {
+				t.Fatalf("loadConfigFile() = %v, want a ConfigError", err)
+			}
+			if len(invalid.Problems) != 1 || invalid.Problems[0] != test.problem {
+				t.Errorf("problems = %s, want %s", strings.Join(invalid.Problems, "; "), test.problem)
+			}
+		})
+	}
+}
+
+func TestConfigRetryAttempts(t *testing.T) {
+	const auth = "[auth]\nrouter_ip = 192.168.123.1\n"
+	for attempts, problem := range map[string]string{
+		"1":  "",
+		"10": "",
+		"0":  "retry.attempts = 0: should be between 1 and 10",
+		"11": "retry.attempts = 11: should be between 1 and 10",
+	} {
+		_, err := loadTestConfig(t, auth+"[retry]\nattempts = "+attempts+"\n")
+		if problem == "" {
+			if err != nil {
+				t.Errorf("attempts = %s: loadConfigFile() = %v", attempts, err)
+			}
+			continue
+		}
+		var invalid *ConfigError
+		if !errors.As(err, &invalid) || len(invalid.Problems) != 1 || invalid.Problems[0] != problem {
+			t.Errorf("attempts = %s: loadConfigFile() = %v, want %s", attempts, err, problem)
+		}
+	}
+}
+
+func TestConfigMQTTTopicsOfRouters(t *testing.T) {
+	const routers = "[router \"home/1\"]\nrouter_ip = 192.168.123.1\n[router \"home_1\"]\nrouter_ip = 192.168.124.1\n"
+	if _, err := loadTestConfig(t, routers); err != nil {
+		t.Errorf("loadConfigFile() without MQTT = %v", err)
+	}
+	_, err := loadTestConfig(t, routers+"[mqtt]\nbroker = tcp://127.0.0.1:1883\n")
+	want := `mqtt.broker = tcp://127.0.0.1:1883: routers "home/1" and "home_1" would share the topic otecstar/home_1, rename one of them`
+	var invalid *ConfigError
+	if !errors.As(err, &invalid) || len(invalid.Problems) != 1 || invalid.Problems[0] != want {
+		t.Errorf("loadConfigFile() = %v, want %s", err, want)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"golang.org/x/term"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/signal"
+	"otecstar/router"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ANSI escape sequences used by the watch screen
+const (
+	ansiReset      = "\x1b[0m"
+	ansiBold       = "\x1b[1m"
+	ansiDim        = "\x1b[2m"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiYellow     = "\x1b[33m"
+	ansiClear      = "\x1b[H\x1b[2J"
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l"
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l"
+)
+
+// watchHistorySize is how many states sparklines can show at most
+const watchHistorySize = 240
+
+// watchEventsSize is how many events the event log keeps
+const watchEventsSize = 100
+
+// watchIntervals are what the interval is switched between with `+` and `-`
+var watchIntervals = []time.Duration{
+	time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute, 5 * time.Minute,
+}
+
+// sparks are the bars of sparklines, from low to high
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// healthColors are the colors of healths, matching the tray icons
+var healthColors = map[Health]string{
+	HealthOK:    ansiGreen,
+	HealthWarn:  ansiYellow,
+	HealthError: ansiRed,
+}
+
+// watchEvent is a line of the event log
+type watchEvent struct {
+	at      time.Time
+	message string
+	health  Health
+}
+
+// Watch is a full screen terminal view of the states captured by a Poller
+type Watch struct {
+	poller   *Poller
+	router   string
+	detector *TransitionDetector
+
+	mu     sync.Mutex
+	states []*State     // Oldest first
+	events []watchEvent // Newest first
+	stats  router.Stats
+	dirty  chan struct{}
+}
+
+// runWatch shows a live view of a router in the terminal until `q` is pressed
+func runWatch(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	addConfigFlags(flags)
+	name := flags.String("router", "", "name of the router to watch, defaults to the first one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("watch needs a terminal, try the status command instead")
+	}
+
+	config, err := prepare()
+	if err != nil {
+		return err
+	}
+	routerConfig, err := config.router(*name)
+	if err != nil {
+		return err
+	}
+	// Logs would scramble the screen, what matters shows up in the event log
+	setLogOutput(ioutil.Discard)
+
+	poller := NewPoller(config, routerConfig)
+	label := routerConfig.RouterIP
+	if routerConfig.Name != routerConfig.RouterIP {
+		label = routerConfig.Name + " (" + routerConfig.RouterIP + ")"
+	}
+	w := Watch{
+		poller:   poller,
+		router:   label,
+		detector: NewTransitionDetector(0),
+		dirty:    make(chan struct{}, 1),
+	}
+	poller.OnState(w.Consume)
+
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	enableVirtualTerminal()
+	fmt.Print(ansiAltScreen)
+	defer func() {
+		fmt.Print(ansiMainScreen)
+		_ = term.Restore(int(os.Stdin.Fd()), oldState)
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		poller.Run()
+		close(done)
+	}()
+	poller.Refresh()
+	w.loop()
+	poller.Stop()
+	<-done
+	return nil
+}
+
+// Consume records a captured state, it's meant to be a Poller consumer
+func (w *Watch) Consume(state *State) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.states = append(w.states, state)
+	if len(w.states) > watchHistorySize {
+		w.states = w.states[1:]
+	}
+
+	stats := w.poller.client.Stats()
+	logins := stats.LoginAttempts - w.stats.LoginAttempts
+	failures := stats.LoginFailures - w.stats.LoginFailures
+	switch {
+	case failures > 0:
+		w.addEvent(state.CapturedAt, "Login failed", HealthError)
+	case stats.SessionExpiries > w.stats.SessionExpiries:
+		w.addEvent(state.CapturedAt, "Session expired, logged in again", HealthWarn)
+	case logins > 0:
+		w.addEvent(state.CapturedAt, "Logged in", HealthOK)
+	}
+	w.stats = stats
+
+	if t := w.detector.Next(state); t != nil {
+		w.addEvent(t.At, transitionMessage(t), t.To)
+	}
+	w.redraw()
+}
+
+// addEvent adds a line to the event log, w.mu must be held
+func (w *Watch) addEvent(at time.Time, message string, health Health) {
+	w.events = append([]watchEvent{{at: at, message: message, health: health}}, w.events...)
+	if len(w.events) > watchEventsSize {
+		w.events = w.events[:watchEventsSize]
+	}
+}
+
+func (w *Watch) redraw() {
+	select {
+	case w.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// loop draws the screen and handles keys until the user quits
+func (w *Watch) loop() {
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	// Redraw every second anyway, to follow the terminal size and update the age of the last state
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		w.draw()
+		select {
+		case <-signals:
+			return
+		case <-ticker.C:
+		case <-w.dirty:
+		case key, ok := <-keys:
+			if !ok {
+				return
+			}
+			switch key {
+			case 'q', 'Q', 0x03: // Ctrl-C is a plain key in raw mode
+				return
+			case 'r', 'R':
+				w.poller.Refresh()
+			case 'p', 'P', ' ':
+				w.poller.SetPaused(!w.poller.Paused())
+			case '+', '=':
+				w.poller.SetInterval(stepInterval(w.poller.Interval(), 1))
+			case '-', '_':
+				w.poller.SetInterval(stepInterval(w.poller.Interval(), -1))
+			}
+		}
+	}
+}
+
+// stepInterval picks the next longer (direction > 0) or shorter interval from watchIntervals
+func stepInterval(current time.Duration, direction int) time.Duration {
+	if direction > 0 {
+		for _, interval := range watchIntervals {
+			if interval > current {
+				return interval
+			}
+		}
+		return current
+	}
+	for i := len(watchIntervals) - 1; i >= 0; i-- {
+		if watchIntervals[i] < current {
+			return watchIntervals[i]
+		}
+	}
+	return current
+}
+
+// draw renders the whole screen
+func (w *Watch) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 40 || height < 10 {
+		width, height = 80, 24
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var lines []string
+	var state *State
+	if len(w.states) > 0 {
+		state = w.states[len(w.states)-1]
+	}
+
+	// Header
+	mode := fmt.Sprintf("every %s", w.poller.Interval())
+	if w.poller.Paused() {
+		mode = ansiYellow + "paused" + ansiReset
+	}
+	health := ansiDim + "waiting" + ansiReset
+	if state != nil {
+		h := Evaluate(state)
+		health = healthColors[h] + ansiBold + string(h) + ansiReset + " " + describeState(state)
+	}
+	lines = append(lines, fmt.Sprintf("%sOTECStar%s %s  %s  %s", ansiBold, ansiReset, w.router, health, mode))
+	lines = append(lines, ansiDim+strings.Repeat("─", width)+ansiReset)
+
+	// Fields, with sparklines of the readings worth following
+	const labelWidth, valueWidth = 16, 14
+	// Room is left for the range printed after sparklines
+	sparkWidth := width - labelWidth - valueWidth - 2 - 16
+	field := func(label, value, color string, spark func(*State) float64) {
+		line := fmt.Sprintf("%-*s%s%-*s%s", labelWidth, label, color, valueWidth, value, ansiReset)
+		if spark != nil && sparkWidth > 0 {
+			line += "  " + w.sparkline(spark, sparkWidth)
+		}
+		lines = append(lines, line)
+	}
+	if state == nil {
+		lines = append(lines, ansiDim+"Logging in..."+ansiReset)
+	} else {
+		conn := func(s router.ConnState) (string, string) {
+			if state.Err != nil {
+				return "-", ansiRed
+			}
+			if s != router.Connected {
+				return s.String(), ansiRed
+			}
+			return s.String(), ansiGreen
+		}
+		// Zero readings are what makes Evaluate warn
+		reading := func(v float64, unit string) (string, string) {
+			if state.Err != nil {
+				return "-", ansiRed
+			}
+			if math.IsNaN(v) {
+				return "- " + unit, ansiDim
+			}
+			if v == 0 {
+				return formatNumber(v) + " " + unit, ansiYellow
+			}
+			return formatNumber(v) + " " + unit, ""
+		}
+
+		value, color := conn(state.WAN)
+		field("WAN", value, color, nil)
+		value, color = conn(state.Link)
+		field("Link", value, color, nil)
+		value, color = reading(state.LinkLoss, "dB")
+		field("Attenuation", value, color, nil)
+		value, color = reading(state.UpRate, "Mbps")
+		field("Upstream rate", value, color, func(s *State) float64 { return s.UpRate })
+		value, color = reading(state.UpSNR, "dB")
+		field("Upstream SNR", value, color, func(s *State) float64 { return s.UpSNR })
+		value, color = reading(state.DownRate, "Mbps")
+		field("Downstream rate", value, color, func(s *State) float64 { return s.DownRate })
+		value, color = reading(state.DownSNR, "dB")
+		field("Downstream SNR", value, color, func(s *State) float64 { return s.DownSNR })
+		if state.Err != nil {
+			lines = append(lines, fmt.Sprintf("%-*s%s%s%s", labelWidth, "Error", ansiRed, truncate(state.Err.Error(), width-labelWidth), ansiReset))
+		}
+		lines = append(lines, ansiDim+fmt.Sprintf("Captured %s ago in %s",
+			time.Since(state.CapturedAt).Round(time.Second), state.RoundTrip.Round(time.Millisecond))+ansiReset)
+	}
+	lines = append(lines, ansiDim+strings.Repeat("─", width)+ansiReset)
+
+	// Event log, newest first, as many as fit
+	lines = append(lines, ansiBold+"Events"+ansiReset)
+	room := height - len(lines) - 2
+	for i := 0; i < room && i < len(w.events); i++ {
+		event := w.events[i]
+		lines = append(lines, fmt.Sprintf("%s%s%s %s%s%s", ansiDim, event.at.Local().Format("01-02 15:04:05"), ansiReset,
+			healthColors[event.health], truncate(event.message, width-15), ansiReset))
+	}
+	for len(lines) < height-1 {
+		lines = append(lines, "")
+	}
+	lines = append(lines, ansiDim+"r refresh  p pause  +/- interval  q quit"+ansiReset)
+
+	// Raw mode does not turn \n into \r\n
+	fmt.Print(ansiClear + strings.Join(lines, "\r\n"))
+}
+
+// sparkline draws the last width readings of states, failed captures and unknown readings are left blank.
+// w.mu must be held.
+func (w *Watch) sparkline(value func(*State) float64, width int) string {
+	states := w.states
+	if len(states) > width {
+		states = states[len(states)-width:]
+	}
+	min, max := 0.0, 0.0
+	first := true
+	for _, s := range states {
+		v := value(s)
+		if s.Err != nil || math.IsNaN(v) {
+			continue
+		}
+		if first || v < min {
+			min = v
+		}
+		if first || v > max {
+			max = v
+		}
+		first = false
+	}
+
+	var b strings.Builder
+	for _, s := range states {
+		if s.Err != nil || math.IsNaN(value(s)) {
+			b.WriteRune(' ')
+			continue
+		}
+		i := len(sparks) - 1
+		if max > min {
+			i = int((value(s) - min) / (max - min) * float64(len(sparks)-1))
+		}
+		b.WriteRune(sparks[i])
+	}
+	if !first {
+		b.WriteString(ansiDim + fmt.Sprintf(" %s-%s", formatNumber(min), formatNumber(max)) + ansiReset)
+	}
+	return b.String()
+}
+
+// truncate cuts s to at most n runes
+func truncate(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n])
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// enableVirtualTerminal is a no-op, terminals understand ANSI escape sequences already
+func enableVirtualTerminal() {}
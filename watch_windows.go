@@ -0,0 +1,16 @@
+package main
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// enableVirtualTerminal makes the console understand ANSI escape sequences
+func enableVirtualTerminal() {
+	handle := windows.Handle(os.Stdout.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(handle, &mode); err != nil {
+		return
+	}
+	_ = windows.SetConsoleMode(handle, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING)
+}
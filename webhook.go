@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// defaultWebhookTemplate renders a generic JSON body
+const defaultWebhookTemplate = `{
+  "router": {{json .Router}},
+  "router_ip": {{json .RouterIP}},
+  "from": {{json .From}},
+  "to": {{json .To}},
+  "message": {{json .Message}},
+  "at": {{json .At}},
+  "downtime_seconds": {{.Downtime.Seconds}},
+  "cause": {{json .Cause}},
+  "state": {{json .State}}
+}`
+
+// webhookQueueSize is how many undelivered events a webhook keeps, the oldest ones are dropped beyond that
+const webhookQueueSize = 100
+
+// WebhookEvent is the data given to webhook templates
+type WebhookEvent struct {
+	Transition
+	// Router is the name of the router, its router_ip unless it's from a `[router "name"]` section
+	Router string
+	// RouterIP is the router_ip of the router
+	RouterIP string
+	// Message is a human readable summary
+	Message string
+}
+
+// webhookFuncs are extra functions for webhook templates
+var webhookFuncs = template.FuncMap{
+	// json encodes a value as JSON, so it can be embedded into JSON bodies safely
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// Webhook delivers health transitions of every router to an HTTP endpoint. Events are queued and retried
+// with backoff, since the endpoint is usually unreachable while the line is down.
+type Webhook struct {
+	config    *WebhookConfig
+	routerIPs map[string]string // By router name
+	template  *template.Template
+	client    *http.Client
+
+	mu       sync.Mutex
+	detector *RouterTransitions
+	queue    [][]byte
+
+	wakeCh    chan struct{}
+	stopCh    chan struct{}
+	doneCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWebhook constructs a Webhook and starts its delivery goroutine, routerIPs by router name are given
+// to templates
+func NewWebhook(config *WebhookConfig, routerIPs map[string]string) (*Webhook, error) {
+	text := config.Template
+	if config.TemplateFile != "" {
+		data, err := ioutil.ReadFile(config.TemplateFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	if text == "" {
+		text = defaultWebhookTemplate
+	}
+	tpl, err := template.New(config.Name).Funcs(webhookFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("webhook %s: %w", config.Name, err)
+	}
+
+	w := Webhook{
+		config:    config,
+		routerIPs: routerIPs,
+		template:  tpl,
+		client:    &http.Client{Timeout: time.Second * 10},
+		detector:  NewRouterTransitions(config.Debounce),
+		wakeCh:    make(chan struct{}, 1),
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	go w.deliver()
+	return &w, nil
+}
+
+// Consume checks a captured state for health changes and queues them, it's meant to be a Poller consumer
+func (w *Webhook) Consume(state *State) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.detector.Next(state)
+	if t == nil {
+		return
+	}
+	event := WebhookEvent{
+		Transition: *t,
+		Router:     state.Router,
+		RouterIP:   w.routerIPs[state.Router],
+		Message:    transitionMessage(t),
+	}
+	var body bytes.Buffer
+	if err := w.template.Execute(&body, &event); err != nil {
+		logger.Error().Err(err).Str("webhook", w.config.Name).Msg("Failed to render webhook body")
+		return
+	}
+	if len(w.queue) >= webhookQueueSize {
+		logger.Warn().Str("webhook", w.config.Name).Msg("Webhook queue full, dropped the oldest event")
+		w.queue = w.queue[1:]
+	}
+	w.queue = append(w.queue, body.Bytes())
+
+	// Deliver right away, the endpoint is likely reachable again when the network recovers
+	select {
+	case w.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops delivering, undelivered events are dropped unless another Webhook adopted them.
+// It is safe to call more than once.
+func (w *Webhook) Close() {
+	w.closeOnce.Do(func() {
+		close(w.stopCh)
+	})
+	<-w.doneCh
+}
+
+// adopt takes the pending transitions and undelivered events of previous over, which is closed.
+// An event previous was delivering is delivered again, the endpoint may have gotten it already.
+func (w *Webhook) adopt(previous *Webhook) {
+	previous.Close()
+	previous.mu.Lock()
+	detector, queue := previous.detector, previous.queue
+	previous.queue = nil
+	previous.mu.Unlock()
+
+	w.mu.Lock()
+	detector.SetDebounce(w.config.Debounce)
+	w.detector = detector
+	w.queue = append(queue, w.queue...)
+	if len(w.queue) > webhookQueueSize {
+		w.queue = w.queue[len(w.queue)-webhookQueueSize:]
+	}
+	w.mu.Unlock()
+	if len(queue) > 0 {
+		logger.Info().Str("webhook", w.config.Name).Int("events", len(queue)).Msg("Webhook took undelivered events over")
+	}
+	select {
+	case w.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends queued events in order until Close is called
+func (w *Webhook) deliver() {
+	defer close(w.doneCh)
+
+	backoff := time.Duration(0)
+	for {
+		var wait <-chan time.Time
+		if backoff > 0 {
+			wait = time.After(backoff)
+		}
+		select {
+		case <-w.stopCh:
+			return
+		case <-w.wakeCh:
+		case <-wait:
+		}
+
+		for {
+			w.mu.Lock()
+			if len(w.queue) == 0 {
+				w.mu.Unlock()
+				backoff = 0
+				break
+			}
+			body := w.queue[0]
+			w.mu.Unlock()
+
+			retry, err := w.send(body)
+			if err != nil && retry {
+				backoff = nextBackoff(backoff, w.config.MaxBackoff)
+				logger.Warn().Err(err).Str("webhook", w.config.Name).Dur("retryIn", backoff).Msg("Webhook delivery failed")
+				break
+			}
+			if err != nil {
+				logger.Error().Err(err).Str("webhook", w.config.Name).Msg("Webhook rejected event, dropped")
+			}
+			w.mu.Lock()
+			w.queue = w.queue[1:]
+			w.mu.Unlock()
+		}
+	}
+}
+
+// send posts body to the endpoint, telling whether it's worth retrying on failure
+func (w *Webhook) send(body []byte) (retry bool, err error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-w.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, w.config.Method, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", w.config.ContentType)
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = ioutil.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode < 300:
+		logger.Debug().Str("webhook", w.config.Name).Int("status", resp.StatusCode).Msg("Webhook delivered")
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
+
+// transitionMessage is a one line human readable summary of t
+func transitionMessage(t *Transition) string {
+	switch {
+	case t.To == HealthError:
+		return fmt.Sprintf("Network disconnected since %s, failed: %s", t.At.Local().Format("15:04:05"), t.Cause)
+	case t.From == HealthError:
+		return fmt.Sprintf("Network back after %s of downtime", t.Downtime.Round(time.Second))
+	default:
+		return "Network status changed to " + describeState(t.State)
+	}
+}